@@ -0,0 +1,153 @@
+package bloom
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// maxBatchNameLen bounds the filter name length accepted by ReadBatch, so
+// that a corrupt stream cannot trigger a huge allocation.
+const maxBatchNameLen = 1 << 16
+
+// WriteBatch writes many named filters to w as a single stream, for storing
+// large numbers of small filters without the overhead of a file, or of a
+// full WriteTo header, per filter. The stream starts with the number of
+// filters as a big-endian uint64. Each filter follows, in name order, as
+// uvarints for the name length, then the name, then _m_, _k_ and the salt
+// length, then the salt, and finally its (m+63)/64 words as 8-byte
+// big-endian values. Read it back with ReadBatch.
+func WriteBatch(w io.Writer, filters map[string]*BloomFilter) (int64, error) {
+	cw := &countingWriter{}
+	bw := bufio.NewWriter(io.MultiWriter(w, cw))
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var buf []byte
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(names)))
+	for _, name := range names {
+		f := filters[name]
+		b := f.bitset()
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf, uint64(f.m))
+		buf = binary.AppendUvarint(buf, uint64(f.k))
+		buf = binary.AppendUvarint(buf, uint64(len(f.salt)))
+		buf = append(buf, f.salt...)
+		for i := range b.data {
+			buf = binary.BigEndian.AppendUint64(buf, uint64(b.data[i].Load()))
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return cw.n, err
+		}
+		buf = buf[:0]
+	}
+	if _, err := bw.Write(buf); err != nil {
+		return cw.n, err
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ReadBatch reads filters written by WriteBatch from r. It reads exactly
+// the batch, one byte at a time for the varints unless r is an
+// io.ByteReader, so wrap files in a bufio.Reader.
+func ReadBatch(r io.Reader) (map[string]*BloomFilter, error) {
+	br, ok := r.(interface {
+		io.Reader
+		io.ByteReader
+	})
+	if !ok {
+		br = &byteReader{r: r}
+	}
+	var count uint64
+	if err := binary.Read(br, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+
+	filters := make(map[string]*BloomFilter)
+	for i := uint64(0); i < count; i++ {
+		name, f, err := readBatchEntry(br)
+		if err != nil {
+			return nil, fmt.Errorf("reading filter %d of %d: %w", i, count, err)
+		}
+		if _, ok := filters[name]; ok {
+			return nil, fmt.Errorf("duplicate filter name %q", name)
+		}
+		filters[name] = f
+	}
+	return filters, nil
+}
+
+func readBatchEntry(r interface {
+	io.Reader
+	io.ByteReader
+}) (string, *BloomFilter, error) {
+	var fields [4]uint64 // Name length, m, k, salt length
+	var name []byte
+	for i := range fields {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", nil, noEOF(err)
+		}
+		fields[i] = v
+		if i == 0 {
+			if v > maxBatchNameLen {
+				return "", nil, fmt.Errorf("invalid name length: %d", v)
+			}
+			name = make([]byte, v)
+			if _, err := io.ReadFull(r, name); err != nil {
+				return "", nil, noEOF(err)
+			}
+		}
+	}
+	m, k, saltLen := fields[1], fields[2], fields[3]
+	if m == 0 || uint64(uint(m)) != m || m > math.MaxInt64/2 {
+		return "", nil, fmt.Errorf("invalid m value: %d", m)
+	}
+	if k == 0 || uint64(uint(k)) != k {
+		return "", nil, fmt.Errorf("invalid k value: %d", k)
+	}
+	if saltLen > maxSaltLen {
+		return "", nil, fmt.Errorf("invalid salt length: %d", saltLen)
+	}
+	salt := make([]byte, saltLen)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return "", nil, noEOF(err)
+	}
+
+	// Copy the words through a buffer that grows with the data actually
+	// read, so that a corrupt m cannot trigger a huge allocation.
+	var words bytes.Buffer
+	need := int64((m + 63) / 64 * 8) // Cannot overflow given the bound on m
+	if n, err := io.CopyN(&words, r, need); err != nil {
+		if n < need && err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, err
+	}
+	f := NewWithSalt(uint(m), uint(k), salt)
+	raw := words.Bytes()
+	b := f.bitset()
+	for i := range b.data {
+		b.data[i].Store(int64(binary.BigEndian.Uint64(raw[i*8:])))
+	}
+	b.syncNonEmpty()
+	return string(name), f, nil
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for reads in the middle of
+// an entry.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
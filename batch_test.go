@@ -0,0 +1,78 @@
+package bloom
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestWriteReadBatch(t *testing.T) {
+	filters := make(map[string]*BloomFilter)
+	var separate int64
+	for i := 0; i < 1000; i++ {
+		var f *BloomFilter
+		if i%10 == 0 {
+			f = NewWithSalt(uint(64+i%200), 3, []byte(fmt.Sprint("salt", i)))
+		} else {
+			f = New(uint(64+i%200), 3)
+		}
+		for j := 0; j < i%7; j++ {
+			f.AddString(fmt.Sprintf("user%d-%d", i, j))
+		}
+		filters[fmt.Sprint("user", i)] = f
+		separate += f.SerializedSize()
+	}
+	filters[""] = New(1, 1)
+
+	var buf bytes.Buffer
+	n, err := WriteBatch(&buf, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteBatch reported %d bytes, wrote %d", n, buf.Len())
+	}
+	if n >= separate*3/4 {
+		t.Errorf("batch takes %d bytes, separate filters %d", n, separate)
+	}
+
+	got, err := ReadBatch(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(filters) {
+		t.Fatalf("read %d filters, want %d", len(got), len(filters))
+	}
+	for name, f := range filters {
+		g, ok := got[name]
+		if !ok || !g.Equal(f) || g.IsEmpty() != f.IsEmpty() {
+			t.Fatalf("filter %q did not round trip", name)
+		}
+	}
+
+	// A reader that is not an io.ByteReader works too.
+	if got, err := ReadBatch(struct{ *bytes.Buffer }{bytes.NewBuffer(buf.Bytes())}); err != nil || len(got) != len(filters) {
+		t.Errorf("reading from a plain io.Reader: %d filters, %v", len(got), err)
+	}
+
+	for _, cut := range []int{0, 4, 8, 9, 20, buf.Len() - 1} {
+		if _, err := ReadBatch(bytes.NewReader(buf.Bytes()[:cut])); err == nil {
+			t.Errorf("reading a batch cut at %d bytes should fail", cut)
+		}
+	}
+}
+
+func TestReadBatchCorrupt(t *testing.T) {
+	for name, in := range map[string][]byte{
+		"m=0":         {0, 0, 0, 0, 0, 0, 0, 1, 1, 'a', 0, 1, 0},
+		"k=0":         {0, 0, 0, 0, 0, 0, 0, 1, 1, 'a', 1, 0, 0},
+		"huge m":      {0, 0, 0, 0, 0, 0, 0, 1, 1, 'a', 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 1, 0},
+		"duplicate":   {0, 0, 0, 0, 0, 0, 0, 2, 1, 'a', 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 'a', 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"long salt":   {0, 0, 0, 0, 0, 0, 0, 1, 1, 'a', 1, 1, 0xff, 0xff, 0x7f},
+		"short words": {0, 0, 0, 0, 0, 0, 0, 1, 1, 'a', 1, 1, 0, 0, 0, 0},
+	} {
+		if _, err := ReadBatch(bytes.NewReader(in)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
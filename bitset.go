@@ -1,18 +1,53 @@
 package bloom
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"math/bits"
+	"sync"
 	"sync/atomic"
+	"unsafe"
 )
 
 // atomicBitSet is a thread-safe bitset implementation using atomic operations.
+//
+// Bit i is stored in word i/64 as the mask 1<<(i%64), so bit 0 is the least
+// significant bit of word 0 and bit 64 the least significant bit of word 1.
+// This mapping is part of every serialized format and must not change.
 type atomicBitSet struct {
-	data []atomic.Int64
-	size uint
+	data  []atomic.Int64
+	size  uint
+	mu    sync.Mutex    // Serializes whole-set mutations such as ClearAllSync and InPlaceUnion
+	flags atomic.Uint32 // flagNonEmpty and flagDirty
+	watch atomic.Pointer[fillWatch]
+
+	// adds counts add operations, see BloomFilter.TotalAdds. Every add
+	// increments it, so it is kept off the cache line of the fields above,
+	// which every Set and Test reads.
+	_    [64]byte
+	adds atomic.Uint64
+}
+
+// Bits of atomicBitSet.flags.
+const (
+	// flagNonEmpty is set whenever a bit may have been set; cleared by
+	// ClearAll.
+	flagNonEmpty uint32 = 1 << iota
+	// flagDirty is set by every mutation; cleared by MarkClean.
+	flagDirty
+)
+
+// fillWatch is a one-shot callback fired once the number of set bits
+// reaches a threshold. See BloomFilter.OnFillThreshold.
+type fillWatch struct {
+	threshold int64        // Number of set bits that fires the callback
+	set       atomic.Int64 // Running count of set bits
+	fired     atomic.Bool
+	cb        func()
 }
 
 // newAtomicBitSet creates a new atomicBitSet with a given size in bits.
@@ -33,6 +68,7 @@ func fromAtomicBitSet(data []int64, size uint) *atomicBitSet {
 			abs.data[i].Store(v)
 		}
 	}
+	abs.syncNonEmpty()
 	return abs
 }
 
@@ -45,7 +81,113 @@ func (bs *atomicBitSet) Set(i uint) {
 	index := i / 64
 	pos := i % 64
 	mask := int64(1) << pos
+	if bs.watch.Load() != nil {
+		bs.setWatched(index, mask)
+		return
+	}
 	bs.data[index].Or(mask)
+	bs.markNonEmpty()
+}
+
+// TestAndSet sets the bit at the given index i and returns whether it was
+// already set. Among concurrent callers setting the same clear bit, exactly
+// one sees false. The previous word comes from the atomic Or, which
+// compiles to a compare-and-swap loop when its result is used. Returns false
+// without setting anything if i is out of range.
+func (bs *atomicBitSet) TestAndSet(i uint) bool {
+	if i >= bs.size {
+		return false
+	}
+	mask := int64(1) << (i % 64)
+	if bs.data[i/64].Or(mask)&mask != 0 {
+		return true
+	}
+	bs.markNonEmpty()
+	bs.countNew(1)
+	return false
+}
+
+// setWatched is the slow path of Set when a fill watch is registered: it
+// needs the previous word to tell whether the bit is newly set.
+func (bs *atomicBitSet) setWatched(index uint, mask int64) {
+	newlySet := bs.data[index].Or(mask)&mask == 0
+	bs.markNonEmpty()
+	if newlySet {
+		bs.countNew(1)
+	}
+}
+
+// countNew reports n newly set bits to the fill watch, if any. Callers that
+// set bits through data directly rather than through Set must call it.
+func (bs *atomicBitSet) countNew(n int) {
+	if w := bs.watch.Load(); w != nil && n > 0 {
+		w.add(int64(n))
+	}
+}
+
+// countCleared reports n bits cleared other than by ClearAll to the fill
+// watch, if any.
+func (bs *atomicBitSet) countCleared(n int) {
+	if w := bs.watch.Load(); w != nil && n > 0 {
+		w.set.Add(-int64(n))
+	}
+}
+
+func (w *fillWatch) add(n int64) {
+	if w.set.Add(n) >= w.threshold && w.fired.CompareAndSwap(false, true) {
+		w.cb()
+	}
+}
+
+// markNonEmpty records that a bit may have been set, which also makes the
+// bitset dirty. It must be called after the bit is written, and only writes
+// when a flag is not already set so that concurrent Sets do not contend on
+// it: in the common case it costs a single atomic load.
+func (bs *atomicBitSet) markNonEmpty() {
+	if bs.flags.Load() != flagNonEmpty|flagDirty {
+		bs.flags.Or(flagNonEmpty | flagDirty)
+	}
+}
+
+// markDirty records a mutation that may not have set any bit.
+func (bs *atomicBitSet) markDirty() {
+	if bs.flags.Load()&flagDirty == 0 {
+		bs.flags.Or(flagDirty)
+	}
+}
+
+// syncNonEmpty recomputes the non-empty flag from the words, after they
+// have been loaded in bulk. It leaves the dirty flag alone.
+func (bs *atomicBitSet) syncNonEmpty() {
+	for i := range bs.data {
+		if bs.data[i].Load() != 0 {
+			bs.flags.Or(flagNonEmpty)
+			return
+		}
+	}
+	bs.flags.And(^flagNonEmpty)
+}
+
+// IsDirty returns true if the bitset was mutated since it was created,
+// loaded, or last marked clean.
+func (bs *atomicBitSet) IsDirty() bool {
+	return bs.flags.Load()&flagDirty != 0
+}
+
+// MarkClean clears the dirty flag. A mutation racing with MarkClean may or
+// may not leave the bitset dirty, so call it before taking the snapshot
+// that is saved, not after.
+func (bs *atomicBitSet) MarkClean() {
+	bs.flags.And(^flagDirty)
+}
+
+// IsEmpty returns true if no bit has been set since the bitset was created
+// or last cleared. It runs in constant time. The flag is conservative: it is
+// not reset when bits are removed by anything other than ClearAll, so
+// IsEmpty may report false for a bitset that has no bits set, but never
+// true for one that has.
+func (bs *atomicBitSet) IsEmpty() bool {
+	return bs.flags.Load()&flagNonEmpty == 0
 }
 
 // Test checks if the bit at the given index i is set.
@@ -59,11 +201,86 @@ func (bs *atomicBitSet) Test(i uint) bool {
 	return (bs.data[index].Load() & mask) != 0
 }
 
+// NumWords returns the number of 64-bit words holding the bits.
+func (bs *atomicBitSet) NumWords() int {
+	return len(bs.data)
+}
+
+// WordAt atomically loads word i, or returns 0 if i is out of range.
+func (bs *atomicBitSet) WordAt(i int) uint64 {
+	if i < 0 || i >= len(bs.data) {
+		return 0
+	}
+	return uint64(bs.data[i].Load())
+}
+
+// SetWordAt atomically replaces word i with v, ignoring bits of v past the
+// size of the bitset. It does nothing if i is out of range.
+func (bs *atomicBitSet) SetWordAt(i int, v uint64) {
+	if i < 0 || i >= len(bs.data) {
+		return
+	}
+	if tail := bs.size % 64; tail != 0 && i == len(bs.data)-1 {
+		v &= 1<<tail - 1
+	}
+	old := uint64(bs.data[i].Swap(int64(v)))
+	// Take the cleared bits off the fill count before adding the set ones,
+	// so that the count never overshoots the real population.
+	bs.countCleared(bits.OnesCount64(old &^ v))
+	if v == 0 {
+		bs.markDirty()
+		return
+	}
+	bs.markNonEmpty()
+	bs.countNew(bits.OnesCount64(v &^ old))
+}
+
+// ClearTrailing zeroes every bit at or past the size of the bitset: the
+// unused high bits of the last word, and any words beyond it, which a
+// decoded bitset may have. Set never writes there, but bulk loads such as
+// From or ReadFrom copy whole words. Bits set concurrently within the size
+// are preserved. Returns the number of bits cleared.
+func (bs *atomicBitSet) ClearTrailing() int {
+	used := int((bs.size + 63) / 64)
+	if used > len(bs.data) {
+		used = len(bs.data)
+	}
+	cleared := 0
+	if tail := bs.size % 64; tail != 0 && used > 0 {
+		mask := int64(1)<<tail - 1
+		cleared += bits.OnesCount64(uint64(bs.data[used-1].And(mask) &^ mask))
+	}
+	for i := used; i < len(bs.data); i++ {
+		cleared += bits.OnesCount64(uint64(bs.data[i].Swap(0)))
+	}
+	if cleared > 0 {
+		bs.markDirty()
+		bs.countCleared(cleared)
+	}
+	return cleared
+}
+
 // ClearAll resets all bits to zero.
+// Each word is zeroed independently, so concurrent Sets may survive the clear.
 func (bs *atomicBitSet) ClearAll() {
+	// Clear the flag first: a Set racing with the clear then either lands
+	// in a word before it is zeroed, or raises the flag again afterwards.
+	bs.flags.And(^flagNonEmpty)
+	bs.markDirty()
 	for i := range bs.data {
 		bs.data[i].Store(0)
 	}
+	if w := bs.watch.Load(); w != nil {
+		w.set.Store(0)
+	}
+}
+
+// ClearAllSync resets all bits to zero while holding the bitset's mutation
+// lock, so it never interleaves with InPlaceUnion or another ClearAllSync.
+func (bs *atomicBitSet) ClearAllSync() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.ClearAll()
 }
 
 // Equal checks if two atomicBitSets are equal.
@@ -82,9 +299,143 @@ func (bs *atomicBitSet) Equal(other *atomicBitSet) bool {
 // InPlaceUnion performs a bitwise OR operation with another atomicBitSet.
 // Assumes both bitsets have the same size.
 func (bs *atomicBitSet) InPlaceUnion(other *atomicBitSet) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.orWords(other)
+}
+
+// orWords is InPlaceUnion without the mutation lock. Each word is merged
+// with an atomic Or, so concurrent calls, Sets and Tests are all safe; only
+// the ordering against ClearAllSync and the other whole-set mutations is
+// lost. Assumes both bitsets have the same size.
+func (bs *atomicBitSet) orWords(other *atomicBitSet) {
+	// The previous words are only needed to count new bits for a fill
+	// watch; using the result of Or makes it a compare-and-swap loop.
+	watched := bs.watch.Load() != nil
+	nonEmpty := false
+	newBits := 0
 	for i := range bs.data {
-		bs.data[i].Or(other.data[i].Load())
+		if v := other.data[i].Load(); v != 0 {
+			if watched {
+				newBits += bits.OnesCount64(uint64(v &^ bs.data[i].Or(v)))
+			} else {
+				bs.data[i].Or(v)
+			}
+			nonEmpty = true
+		}
+	}
+	if nonEmpty {
+		bs.markNonEmpty()
+	}
+	bs.countNew(newBits)
+}
+
+// InPlaceUnionUnsafe performs a bitwise OR operation with another
+// atomicBitSet using plain, non-atomic loads and stores, which is several
+// times faster than InPlaceUnion on large bitsets. It is unsafe under
+// concurrency: bs must have no other reader or writer, and other no
+// writer, for the duration of the call, or bits may be lost and the race
+// detector will report it. Assumes both bitsets have the same size.
+func (bs *atomicBitSet) InPlaceUnionUnsafe(other *atomicBitSet) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	dst := bs.words()
+	src := other.words()[:len(dst)]
+	if bs.watch.Load() != nil {
+		// Count the new bits for the fill watch, word by word.
+		newBits := 0
+		for i := range dst {
+			newBits += bits.OnesCount64(uint64(src[i] &^ dst[i]))
+			dst[i] |= src[i]
+		}
+		if newBits > 0 {
+			bs.markNonEmpty()
+			bs.countNew(newBits)
+		}
+		return
+	}
+	var nonEmpty int64
+	i := 0
+	for ; i+4 <= len(dst); i += 4 {
+		d, s := dst[i:i+4:i+4], src[i:i+4:i+4]
+		d[0] |= s[0]
+		d[1] |= s[1]
+		d[2] |= s[2]
+		d[3] |= s[3]
+		nonEmpty |= s[0] | s[1] | s[2] | s[3]
+	}
+	for ; i < len(dst); i++ {
+		dst[i] |= src[i]
+		nonEmpty |= src[i]
+	}
+	if nonEmpty != 0 {
+		bs.markNonEmpty()
+	}
+}
+
+// words returns a plain view of the words of bs. atomic.Int64 has the
+// layout of an int64, so the view aliases data. It must only be used while
+// nothing accesses bs concurrently.
+func (bs *atomicBitSet) words() []int64 {
+	if len(bs.data) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*int64)(unsafe.Pointer(&bs.data[0])), len(bs.data))
+}
+
+// InPlaceSymmetricDifference performs a bitwise XOR operation with another
+// atomicBitSet. There is no atomic XOR, so each word is updated with a
+// compare-and-swap loop so that a concurrent Set of another bit in the same
+// word is not overwritten.
+// Assumes both bitsets have the same size.
+func (bs *atomicBitSet) InPlaceSymmetricDifference(other *atomicBitSet) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	nonEmpty := false
+	newBits, cleared := 0, 0
+	for i := range bs.data {
+		v := other.data[i].Load()
+		if v == 0 {
+			continue
+		}
+		bs.markDirty()
+		for {
+			old := bs.data[i].Load()
+			if bs.data[i].CompareAndSwap(old, old^v) {
+				nonEmpty = nonEmpty || old^v != 0
+				newBits += bits.OnesCount64(uint64(v &^ old))
+				cleared += bits.OnesCount64(uint64(v & old))
+				break
+			}
+		}
+	}
+	if nonEmpty {
+		bs.markNonEmpty()
 	}
+	bs.countCleared(cleared)
+	bs.countNew(newBits)
+}
+
+// StoreUnion sets bs to the bitwise OR of a and b.
+// Assumes all three bitsets have the same size; bs may alias a or b.
+func (bs *atomicBitSet) StoreUnion(a, b *atomicBitSet) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.markDirty()
+	nonEmpty := false
+	newBits, cleared := 0, 0
+	for i := range bs.data {
+		v := a.data[i].Load() | b.data[i].Load()
+		old := bs.data[i].Swap(v)
+		nonEmpty = nonEmpty || v != 0
+		newBits += bits.OnesCount64(uint64(v &^ old))
+		cleared += bits.OnesCount64(uint64(old &^ v))
+	}
+	if nonEmpty {
+		bs.markNonEmpty()
+	}
+	bs.countCleared(cleared)
+	bs.countNew(newBits)
 }
 
 // Count returns the number of set bits.
@@ -96,6 +447,90 @@ func (bs *atomicBitSet) Count() uint {
 	return count
 }
 
+// CountRange returns the number of set bits in [start, end).
+// The range is clamped to the size of the bitset.
+func (bs *atomicBitSet) CountRange(start, end uint) uint {
+	if end > bs.size {
+		end = bs.size
+	}
+	if start >= end {
+		return 0
+	}
+	first, last := start/64, (end-1)/64
+	var count uint
+	for i := first; i <= last; i++ {
+		w := uint64(bs.data[i].Load())
+		if i == first {
+			w &= ^uint64(0) << (start % 64)
+		}
+		if i == last && end%64 != 0 {
+			w &= ^uint64(0) >> (64 - end%64)
+		}
+		count += uint(bits.OnesCount64(w))
+	}
+	return count
+}
+
+// NextSet returns the index of the first set bit at or after i, and false
+// if there is none. Iterate over the set bits with
+//
+//	for i, ok := bs.NextSet(0); ok; i, ok = bs.NextSet(i + 1) {
+//		...
+//	}
+func (bs *atomicBitSet) NextSet(i uint) (uint, bool) {
+	if i >= bs.size {
+		return 0, false
+	}
+	index := i / 64
+	w := uint64(bs.data[index].Load()) >> (i % 64)
+	if w != 0 {
+		next := i + uint(bits.TrailingZeros64(w))
+		return next, next < bs.size
+	}
+	for index++; index < uint(len(bs.data)); index++ {
+		if w := uint64(bs.data[index].Load()); w != 0 {
+			next := index*64 + uint(bits.TrailingZeros64(w))
+			return next, next < bs.size
+		}
+	}
+	return 0, false
+}
+
+// Rank returns the number of set bits before index i, i.e. in [0, i).
+// It scans the words up to i.
+func (bs *atomicBitSet) Rank(i uint) uint {
+	return bs.CountRange(0, i)
+}
+
+// Select returns the index of the set bit of rank n, counting from zero,
+// so that Rank(i) == n for the returned i. Returns false if fewer than n+1
+// bits are set. It scans the words up to the result.
+func (bs *atomicBitSet) Select(n uint) (uint, bool) {
+	for i := range bs.data {
+		w := uint64(bs.data[i].Load())
+		if c := uint(bits.OnesCount64(w)); n >= c {
+			n -= c
+			continue
+		}
+		for ; n > 0; n-- {
+			w &= w - 1 // Clear the lowest set bit
+		}
+		index := uint(i)*64 + uint(bits.TrailingZeros64(w))
+		return index, index < bs.size
+	}
+	return 0, false
+}
+
+// UnionCount returns the number of bits set in the union of bs and other,
+// without modifying either. Assumes both bitsets have the same size.
+func (bs *atomicBitSet) UnionCount(other *atomicBitSet) uint {
+	var count uint
+	for i := range bs.data {
+		count += uint(bits.OnesCount64(uint64(bs.data[i].Load() | other.data[i].Load())))
+	}
+	return count
+}
+
 // WriteTo writes the bitset data to a stream.
 func (bs *atomicBitSet) WriteTo(stream io.Writer) (int64, error) {
 	var totalBytes int64
@@ -126,40 +561,288 @@ func (bs *atomicBitSet) WriteTo(stream io.Writer) (int64, error) {
 	return totalBytes, nil
 }
 
+// SerializedSize returns the number of bytes WriteTo will emit for this bitset.
+func (bs *atomicBitSet) SerializedSize() int64 {
+	return int64(binary.Size(uint64(0))) * int64(2+len(bs.data))
+}
+
 // ReadFrom reads the bitset data from a stream.
 func (bs *atomicBitSet) ReadFrom(stream io.Reader) (int64, error) {
 	var totalBytes int64
-	var size uint64
-	// Read size
-	err := binary.Read(stream, binary.BigEndian, &size)
-	if err != nil {
+	var size, dataLen uint64
+	for _, v := range []*uint64{&size, &dataLen} {
+		err := binary.Read(stream, binary.BigEndian, v)
+		if err != nil {
+			return totalBytes, err
+		}
+		totalBytes += int64(binary.Size(uint64(0)))
+	}
+	if err := checkDecodedShape(size, dataLen); err != nil {
 		return totalBytes, err
 	}
+
+	// Copy the words through a buffer that grows with the data actually
+	// read, so that a corrupt length cannot trigger a huge allocation.
+	var words bytes.Buffer
+	n, err := io.CopyN(&words, stream, int64(dataLen*8))
+	totalBytes += n
+	if err != nil {
+		return totalBytes, noEOF(err)
+	}
+	raw := words.Bytes()
 	bs.size = uint(size)
-	totalBytes += int64(binary.Size(uint64(0)))
+	bs.data = make([]atomic.Int64, dataLen)
+	for i := range bs.data {
+		bs.data[i].Store(int64(binary.BigEndian.Uint64(raw[i*8:])))
+	}
+	bs.syncNonEmpty()
+	return totalBytes, nil
+}
+
+// WriteToSparse writes only the nonzero words of the bitset to a stream.
+// After the size and data length it writes the number of nonzero words,
+// then for each of them the gap from the previous one as a uvarint followed
+// by the word itself.
+func (bs *atomicBitSet) WriteToSparse(stream io.Writer) (int64, error) {
+	return bs.writeSparse(stream, func(i int) int64 { return bs.data[i].Load() })
+}
+
+// WriteDelta writes, in the WriteToSparse format, the bits of bs that are
+// not set in since. Assumes both bitsets have the same size; a nil since
+// writes every set bit.
+func (bs *atomicBitSet) WriteDelta(stream io.Writer, since *atomicBitSet) (int64, error) {
+	if since == nil {
+		return bs.WriteToSparse(stream)
+	}
+	return bs.writeSparse(stream, func(i int) int64 { return bs.data[i].Load() &^ since.data[i].Load() })
+}
+
+// writeSparse writes the words returned by word, for every word index of
+// bs, in the WriteToSparse format.
+func (bs *atomicBitSet) writeSparse(stream io.Writer, word func(i int) int64) (int64, error) {
+	var totalBytes int64
+	type entry struct {
+		index uint64
+		word  int64
+	}
+	var entries []entry
+	for i := range bs.data {
+		if w := word(i); w != 0 {
+			entries = append(entries, entry{uint64(i), w})
+		}
+	}
 
-	// Read data length
-	var dataLen uint64
-	err = binary.Read(stream, binary.BigEndian, &dataLen)
+	for _, v := range []uint64{uint64(bs.size), uint64(len(bs.data)), uint64(len(entries))} {
+		err := binary.Write(stream, binary.BigEndian, v)
+		if err != nil {
+			return totalBytes, err
+		}
+		totalBytes += int64(binary.Size(v))
+	}
+
+	var buf []byte
+	next := uint64(0)
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf[:0], e.index-next)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.word))
+		n, err := stream.Write(buf)
+		totalBytes += int64(n)
+		if err != nil {
+			return totalBytes, err
+		}
+		next = e.index + 1
+	}
+	return totalBytes, nil
+}
+
+// ReadFromSparse reads a bitset written by WriteToSparse from a stream.
+func (bs *atomicBitSet) ReadFromSparse(stream io.Reader) (int64, error) {
+	var data []atomic.Int64
+	size, n, err := readSparse(stream, func(size, dataLen uint64) error {
+		data = make([]atomic.Int64, dataLen)
+		return nil
+	}, func(index uint64, word int64) {
+		data[index].Store(word)
+	})
 	if err != nil {
-		return totalBytes, err
+		return n, err
 	}
-	totalBytes += int64(binary.Size(uint64(0)))
+	bs.size = uint(size)
+	bs.data = data
+	bs.syncNonEmpty()
+	return n, nil
+}
 
-	// Read data content
-	bs.data = make([]atomic.Int64, dataLen)
-	for i := uint64(0); i < dataLen; i++ {
-		var val int64
-		err = binary.Read(stream, binary.BigEndian, &val)
+// ApplyDelta reads a delta written by WriteDelta from a stream and ORs it
+// into bs. The delta must have been written from a bitset of the same size.
+func (bs *atomicBitSet) ApplyDelta(stream io.Reader) (int64, error) {
+	newBits := 0
+	_, n, err := readSparse(stream, func(size, dataLen uint64) error {
+		if size != uint64(bs.size) || dataLen != uint64(len(bs.data)) {
+			return fmt.Errorf("delta has %d bits in %d words, bitset has %d in %d", size, dataLen, bs.size, len(bs.data))
+		}
+		return nil
+	}, func(index uint64, word int64) {
+		old := bs.data[index].Or(word)
+		newBits += bits.OnesCount64(uint64(word &^ old))
+	})
+	if newBits > 0 {
+		bs.markNonEmpty()
+		bs.countNew(newBits)
+	}
+	return n, err
+}
+
+// mergeChunkWords is the number of words MergeFrom reads at a time.
+const mergeChunkWords = 512
+
+// MergeFrom reads a bitset written by WriteTo from a stream and ORs it into
+// bs, without materializing it: words are read through a fixed buffer of
+// mergeChunkWords words. The bitset must have been written from a bitset of
+// the same size.
+func (bs *atomicBitSet) MergeFrom(stream io.Reader) (int64, error) {
+	var totalBytes int64
+	var size, dataLen uint64
+	for _, v := range []*uint64{&size, &dataLen} {
+		err := binary.Read(stream, binary.BigEndian, v)
 		if err != nil {
 			return totalBytes, err
 		}
-		bs.data[i].Store(val)
-		totalBytes += int64(binary.Size(val))
+		totalBytes += int64(binary.Size(uint64(0)))
+	}
+	if size != uint64(bs.size) || dataLen != uint64(len(bs.data)) {
+		return totalBytes, fmt.Errorf("stream has %d bits in %d words, bitset has %d in %d", size, dataLen, bs.size, len(bs.data))
+	}
+
+	var buf [mergeChunkWords * 8]byte
+	newBits := 0
+	defer func() {
+		if newBits > 0 {
+			bs.markNonEmpty()
+			bs.countNew(newBits)
+		}
+	}()
+	for i := 0; i < len(bs.data); {
+		words := len(bs.data) - i
+		if words > mergeChunkWords {
+			words = mergeChunkWords
+		}
+		n, err := io.ReadFull(stream, buf[:words*8])
+		totalBytes += int64(n)
+		if err != nil {
+			return totalBytes, err
+		}
+		for j := 0; j < words; j++ {
+			word := int64(binary.BigEndian.Uint64(buf[j*8:]))
+			if word == 0 {
+				continue
+			}
+			old := bs.data[i+j].Or(word)
+			newBits += bits.OnesCount64(uint64(word &^ old))
+		}
+		i += words
 	}
 	return totalBytes, nil
 }
 
+// readSparse reads the WriteToSparse format from a stream. It checks the
+// shape of the bitset with checkDecodedShape and passes it to start, which
+// may reject it, then each nonzero word to store, and returns the bitset
+// size.
+func readSparse(stream io.Reader, start func(size, dataLen uint64) error, store func(index uint64, word int64)) (size uint64, n int64, err error) {
+	br := &byteReader{r: stream}
+	var dataLen, count uint64
+	for _, v := range []*uint64{&size, &dataLen, &count} {
+		err := binary.Read(br, binary.BigEndian, v)
+		if err != nil {
+			return 0, br.n, err
+		}
+	}
+	if err := checkDecodedShape(size, dataLen); err != nil {
+		return 0, br.n, err
+	}
+	if count > dataLen {
+		return 0, br.n, fmt.Errorf("invalid sparse bitset: %d words of %d", count, dataLen)
+	}
+	if err := start(size, dataLen); err != nil {
+		return 0, br.n, err
+	}
+
+	next := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		gap, err := binary.ReadUvarint(br)
+		if err != nil {
+			return 0, br.n, err
+		}
+		var word int64
+		err = binary.Read(br, binary.BigEndian, &word)
+		if err != nil {
+			return 0, br.n, err
+		}
+		index := next + gap
+		if index < next || index >= dataLen {
+			return 0, br.n, fmt.Errorf("invalid sparse bitset: word index %d out of range", index)
+		}
+		store(index, word)
+		next = index + 1
+	}
+	return size, br.n, nil
+}
+
+// maxDecodeWords bounds the number of words a decoded bitset may have, 2^38
+// bits or 32 GiB, so that a corrupt header cannot trigger a huge
+// allocation.
+const maxDecodeWords = 1 << 32
+
+// checkDecodedShape returns an error unless dataLen words hold exactly size
+// bits, as in every bitset this package writes, and are few enough to be
+// allocated.
+func checkDecodedShape(size, dataLen uint64) error {
+	want, err := checkDecodedSize(size)
+	if err != nil {
+		return err
+	}
+	if dataLen != want {
+		return fmt.Errorf("invalid data length: %d words for size %d", dataLen, size)
+	}
+	return nil
+}
+
+// checkDecodedSize returns the number of words holding size bits, or an
+// error if they are too many to be allocated.
+func checkDecodedSize(size uint64) (words uint64, err error) {
+	if uint64(uint(size)) != size {
+		return 0, fmt.Errorf("invalid bitset size: %d", size)
+	}
+	words = size / 64
+	if size%64 != 0 {
+		words++
+	}
+	if words > maxDecodeWords || words > math.MaxInt/8 {
+		return 0, fmt.Errorf("bitset too large: %d words", words)
+	}
+	return words, nil
+}
+
+// byteReader adapts an io.Reader to io.ByteReader without reading ahead,
+// and counts the bytes consumed.
+type byteReader struct {
+	r   io.Reader
+	n   int64
+	buf [1]byte
+}
+
+func (br *byteReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	br.n += int64(n)
+	return n, err
+}
+
+func (br *byteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(br, br.buf[:])
+	return br.buf[0], err
+}
+
 // MarshalJSON implements json.Marshaler interface.
 func (bs *atomicBitSet) MarshalJSON() ([]byte, error) {
 	rawData := make([]int64, len(bs.data))
@@ -172,32 +855,55 @@ func (bs *atomicBitSet) MarshalJSON() ([]byte, error) {
 	})
 }
 
-// UnmarshalJSON implements json.Unmarshaler interface.
+// UnmarshalJSON implements json.Unmarshaler interface. Besides the array
+// of words written by MarshalJSON, "data" may be a base64 string (standard
+// encoding) of the words as 8-byte big-endian values, as in WriteTo, which
+// older encoders produced.
 func (bs *atomicBitSet) UnmarshalJSON(data []byte) error {
-	var j map[string]interface{}
+	var j map[string]json.RawMessage
 	err := json.Unmarshal(data, &j)
 	if err != nil {
 		return err
 	}
 
-	sizeFloat, ok := j["size"].(float64)
-	if !ok {
+	var size uint64
+	if err := json.Unmarshal(j["size"], &size); err != nil {
 		return fmt.Errorf("invalid size type in JSON")
 	}
-	bs.size = uint(sizeFloat)
 
-	rawDataInterface, ok := j["data"].([]interface{})
-	if !ok {
+	var raw []int64
+	switch d := bytes.TrimSpace(j["data"]); {
+	case len(d) > 0 && d[0] == '[':
+		// Decode the words as integers; going through float64 would round
+		// words above 2^53.
+		if err := json.Unmarshal(d, &raw); err != nil {
+			return fmt.Errorf("invalid data element type in JSON")
+		}
+	case len(d) > 0 && d[0] == '"':
+		var encoded []byte // encoding/json decodes base64 into []byte
+		if err := json.Unmarshal(d, &encoded); err != nil {
+			return fmt.Errorf("invalid base64 data in JSON: %w", err)
+		}
+		if len(encoded)%8 != 0 {
+			return fmt.Errorf("invalid data length in JSON: %d bytes is not a whole number of words", len(encoded))
+		}
+		raw = make([]int64, len(encoded)/8)
+		for i := range raw {
+			raw[i] = int64(binary.BigEndian.Uint64(encoded[i*8:]))
+		}
+	default:
 		return fmt.Errorf("invalid data type in JSON")
 	}
+	if want := (size + 63) / 64; uint64(len(raw)) != want {
+		return fmt.Errorf("invalid data length in JSON: %d words for size %d, want %d", len(raw), size, want)
+	}
 
-	bs.data = make([]atomic.Int64, len(rawDataInterface))
-	for i, v := range rawDataInterface {
-		valFloat, ok := v.(float64)
-		if !ok {
-			return fmt.Errorf("invalid data element type in JSON")
-		}
-		bs.data[i].Store(int64(valFloat))
+	words := make([]atomic.Int64, len(raw))
+	for i, v := range raw {
+		words[i].Store(v)
 	}
+	bs.size = uint(size)
+	bs.data = words
+	bs.syncNonEmpty()
 	return nil
 }
@@ -0,0 +1,246 @@
+package bloom
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCountRange(t *testing.T) {
+	bs := newAtomicBitSet(200)
+	set := []uint{0, 5, 63, 64, 70, 127, 128, 199}
+	for _, i := range set {
+		bs.Set(i)
+	}
+	brute := func(start, end uint) uint {
+		var c uint
+		for _, i := range set {
+			if i >= start && i < end {
+				c++
+			}
+		}
+		return c
+	}
+	cases := [][2]uint{
+		{0, 200}, {0, 1}, {1, 5}, {1, 6}, {5, 64}, {60, 70},
+		{63, 65}, {64, 128}, {65, 127}, {100, 300}, {150, 100}, {200, 210},
+	}
+	for _, c := range cases {
+		want := brute(c[0], min(c[1], 200))
+		if got := bs.CountRange(c[0], c[1]); got != want {
+			t.Errorf("CountRange(%d, %d) = %d, want %d", c[0], c[1], got, want)
+		}
+	}
+	if bs.CountRange(0, 200) != bs.Count() {
+		t.Error("CountRange over the whole bitset should equal Count")
+	}
+}
+
+// The bit index to word mapping is a stable contract; see atomicBitSet.
+func TestBitIndexMapping(t *testing.T) {
+	bs := newAtomicBitSet(128)
+	for _, i := range []uint{0, 1, 63, 64, 127} {
+		bs.Set(i)
+	}
+	want := []uint64{0x8000000000000003, 0x8000000000000001}
+	for i, w := range want {
+		if got := uint64(bs.data[i].Load()); got != w {
+			t.Errorf("word %d = %#016x, want %#016x", i, got, w)
+		}
+	}
+}
+
+func TestTestAndSet(t *testing.T) {
+	bs := newAtomicBitSet(100)
+	if bs.TestAndSet(42) || !bs.TestAndSet(42) || !bs.Test(42) {
+		t.Error("TestAndSet should report the bit clear, then set")
+	}
+	if bs.IsEmpty() || bs.Count() != 1 {
+		t.Errorf("bitset has %d bits set, want 1", bs.Count())
+	}
+	if bs.TestAndSet(100) || bs.Count() != 1 {
+		t.Error("an out-of-range TestAndSet should do nothing")
+	}
+
+	for round := 0; round < 100; round++ {
+		bs := newAtomicBitSet(128)
+		var first atomic.Int32
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if !bs.TestAndSet(77) {
+					first.Add(1)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if n := first.Load(); n != 1 {
+			t.Fatalf("%d callers saw the bit clear, want exactly 1", n)
+		}
+	}
+}
+
+func TestNextSet(t *testing.T) {
+	for _, size := range []uint{1, 63, 64, 65, 130, 200} {
+		bs := newAtomicBitSet(size)
+		var want []uint
+		for i := uint(0); i < size; i += 7 {
+			bs.Set(i)
+			want = append(want, i)
+		}
+		bs.Set(size - 1)
+		if want[len(want)-1] != size-1 {
+			want = append(want, size-1)
+		}
+		var got []uint
+		for i, ok := bs.NextSet(0); ok; i, ok = bs.NextSet(i + 1) {
+			got = append(got, i)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("size %d: NextSet visited %v, want %v", size, got, want)
+		}
+	}
+	if _, ok := newAtomicBitSet(100).NextSet(0); ok {
+		t.Error("empty bitset should have no set bit")
+	}
+}
+
+func TestRankSelect(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, size := range []uint{1, 63, 64, 65, 200, 1000} {
+		for _, density := range []float64{0, 0.05, 0.5, 1} {
+			bs := newAtomicBitSet(size)
+			var set []uint // Brute-force reference: the set bits in order
+			for i := uint(0); i < size; i++ {
+				if r.Float64() < density {
+					bs.Set(i)
+					set = append(set, i)
+				}
+			}
+			rank := uint(0)
+			for i := uint(0); i <= size+1; i++ {
+				if got := bs.Rank(i); got != rank {
+					t.Fatalf("size %d: Rank(%d) = %d, want %d", size, i, got, rank)
+				}
+				if i < size && bs.Test(i) {
+					rank++
+				}
+			}
+			for n, want := range set {
+				if got, ok := bs.Select(uint(n)); !ok || got != want {
+					t.Fatalf("size %d: Select(%d) = %d, %v, want %d", size, n, got, ok, want)
+				}
+			}
+			if _, ok := bs.Select(uint(len(set))); ok {
+				t.Errorf("size %d: Select(%d) found a bit past the last one", size, len(set))
+			}
+		}
+	}
+
+	// Bits past the size, e.g. from From with dirty words, are not selected.
+	bs := fromAtomicBitSet([]int64{1, -1}, 70)
+	if i, ok := bs.Select(6); !ok || i != 69 {
+		t.Errorf("Select(6) = %d, %v, want 69", i, ok)
+	}
+	if _, ok := bs.Select(7); ok {
+		t.Error("Select(7) should not find a bit past the size")
+	}
+}
+
+func TestInPlaceSymmetricDifference(t *testing.T) {
+	a := fromAtomicBitSet([]int64{0b1100, -1, 0}, 192)
+	b := fromAtomicBitSet([]int64{0b1010, -1, 7}, 192)
+	a.InPlaceSymmetricDifference(b)
+	want := []int64{0b0110, 0, 7}
+	for i, w := range want {
+		if got := a.data[i].Load(); got != w {
+			t.Errorf("word %d = %b, want %b", i, got, w)
+		}
+	}
+	// XOR with itself cancels every bit.
+	a.InPlaceSymmetricDifference(a)
+	if a.Count() != 0 {
+		t.Errorf("x ^ x has %d bits set, want 0", a.Count())
+	}
+}
+
+func TestInPlaceUnionUnsafe(t *testing.T) {
+	for _, size := range []uint{1, 64, 200, 64 * 9} {
+		a := newAtomicBitSet(size)
+		b := newAtomicBitSet(size)
+		for i := uint(0); i < size; i += 3 {
+			a.Set(i)
+		}
+		for i := uint(0); i < size; i += 5 {
+			b.Set(i)
+		}
+		want := newAtomicBitSet(size)
+		want.StoreUnion(a, b)
+		a.InPlaceUnionUnsafe(b)
+		if !a.Equal(want) {
+			t.Errorf("size %d: unsafe union differs from StoreUnion", size)
+		}
+	}
+	empty := newAtomicBitSet(300)
+	empty.InPlaceUnionUnsafe(newAtomicBitSet(300))
+	if !empty.IsEmpty() {
+		t.Error("union of empty bitsets should stay empty")
+	}
+	full := newAtomicBitSet(300)
+	full.InPlaceUnionUnsafe(fromAtomicBitSet([]int64{0, 0, 0, 0, 1}, 300))
+	if full.IsEmpty() || !full.Test(256) {
+		t.Error("union should set bit 256")
+	}
+}
+
+// benchmarkUnion ORs a billion-bit bitset into another.
+func benchmarkUnion(b *testing.B, union func(dst, src *atomicBitSet)) {
+	const size = 1 << 30
+	dst := newAtomicBitSet(size)
+	src := newAtomicBitSet(size)
+	for i := uint(0); i < size; i += 97 {
+		src.Set(i)
+	}
+	b.SetBytes(size / 8)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		union(dst, src)
+	}
+}
+
+func BenchmarkInPlaceUnion(b *testing.B) {
+	benchmarkUnion(b, (*atomicBitSet).InPlaceUnion)
+}
+
+func BenchmarkInPlaceUnionUnsafe(b *testing.B) {
+	benchmarkUnion(b, (*atomicBitSet).InPlaceUnionUnsafe)
+}
+
+func TestClearTrailing(t *testing.T) {
+	bs := fromAtomicBitSet([]int64{-1, -1}, 100)
+	if n := bs.ClearTrailing(); n != 28 {
+		t.Errorf("ClearTrailing() = %d, want 28", n)
+	}
+	if bs.Count() != 100 || !bs.Test(99) {
+		t.Errorf("Count() = %d after ClearTrailing, want 100", bs.Count())
+	}
+	if n := bs.ClearTrailing(); n != 0 {
+		t.Errorf("second ClearTrailing() = %d, want 0", n)
+	}
+
+	// A decoded bitset may have words past its size.
+	extra := &atomicBitSet{size: 64, data: make([]atomic.Int64, 3)}
+	for i := range extra.data {
+		extra.data[i].Store(-1)
+	}
+	if n := extra.ClearTrailing(); n != 128 || extra.Count() != 64 {
+		t.Errorf("ClearTrailing() = %d leaving %d bits, want 128 leaving 64", n, extra.Count())
+	}
+}
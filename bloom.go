@@ -10,21 +10,52 @@ This implementation uses an atomic bitset for thread-safety.
 package bloom
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding"
 	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math"
+	"math/bits"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
+// Filter is the set of operations shared by the filters of this package, for
+// code that should not depend on a particular variant. Adds go through AddN
+// because Add returns the concrete type for chaining.
+type Filter interface {
+	AddN(data []byte) uint64
+	Test(data []byte) bool
+	Cap() uint
+	K() uint
+	Count() uint
+	io.WriterTo
+	io.ReaderFrom
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
 // A BloomFilter is a representation of a set of _n_ items, where the main
 // requirement is to make membership queries; _i.e._, whether an item is a
 // member of a set.
 type BloomFilter struct {
-	m uint          // Number of bits
-	k uint          // Number of hash functions
-	b *atomicBitSet // The atomic bitset
+	m        uint             // Number of bits
+	k        uint             // Number of hash functions
+	b        *atomicBitSet    // The atomic bitset; access it through bitset
+	salt     []byte           // Optional salt mixed into the hashes; nil if none
+	saltHash [4]uint64        // Base hashes of salt, computed once by setSalt
+	cache    *hashCache       // Optional cache of string hashes; nil if none
+	tracer   func(TraceEvent) // Optional, see SetTracer
+	strict   bool             // Keep bits past m cleared, see StrictBounds
 }
 
 func max(x, y uint) uint {
@@ -39,7 +70,83 @@ func max(x, y uint) uint {
 func New(m uint, k uint) *BloomFilter {
 	m = max(1, m)
 	k = max(1, k)
-	return &BloomFilter{m, k, newAtomicBitSet(m)}
+	return newFilter(m, k, newAtomicBitSet(m))
+}
+
+// newFilter creates a filter with _m_ bits and _k_ hashing functions backed
+// by b.
+func newFilter(m, k uint, b *atomicBitSet) *BloomFilter {
+	return &BloomFilter{m: m, k: k, b: b}
+}
+
+// NewStrict is like New but returns an error instead of raising _m_ or _k_
+// to one when it is zero, to catch configurations that compute a zero size.
+func NewStrict(m uint, k uint) (*BloomFilter, error) {
+	if m == 0 {
+		return nil, fmt.Errorf("invalid m value: %d", m)
+	}
+	if k == 0 {
+		return nil, fmt.Errorf("invalid k value: %d", k)
+	}
+	return New(m, k), nil
+}
+
+// NewWithSalt creates a new Bloom filter with _m_ bits and _k_ hashing
+// functions whose hashes are mixed with salt, so that the same data maps to
+// different bits in filters with different salts. Salts can be derived from
+// arbitrary strings, e.g. a domain name per filter of a battery. The salt is
+// copied and persisted with the filter; an empty salt is the same as New.
+func NewWithSalt(m uint, k uint, salt []byte) *BloomFilter {
+	f := New(m, k)
+	f.setSalt(salt)
+	return f
+}
+
+// setSalt stores a copy of salt, or nil if it is empty, and precomputes its
+// hashes.
+func (f *BloomFilter) setSalt(salt []byte) {
+	if len(salt) == 0 {
+		f.salt, f.saltHash = nil, [4]uint64{}
+		return
+	}
+	f.salt = bytes.Clone(salt)
+	f.saltHash = baseHashes(f.salt)
+}
+
+// Salt returns the filter's salt, or nil if it has none.
+func (f *BloomFilter) Salt() []byte {
+	return bytes.Clone(f.salt)
+}
+
+// Options configures a Bloom filter created with NewWithOptions.
+// The zero value of each field selects the same default as New.
+type Options struct {
+	M    uint   // Number of bits; values below 1 are raised to 1
+	K    uint   // Number of hash functions; values below 1 are raised to 1
+	Salt []byte // Salt mixed into the hashes, see NewWithSalt
+}
+
+// NewWithOptions creates a new Bloom filter configured by opts.
+func NewWithOptions(opts Options) *BloomFilter {
+	return NewWithSalt(opts.M, opts.K, opts.Salt)
+}
+
+// NewPow2 creates a new Bloom filter with at least _minBits_ bits and _k_
+// hashing functions, rounding the number of bits up to the next power of
+// two. Locations in such filters are computed with a mask instead of a
+// modulo. Since both give the same bit, the addressing needs no extra state
+// and a reloaded filter behaves identically.
+func NewPow2(minBits uint, k uint) *BloomFilter {
+	m := uint(1) << bits.Len(max(1, minBits)-1)
+	return New(m, k)
+}
+
+// NewWordAligned creates a new Bloom filter with _k_ hashing functions and
+// _m_ rounded up to a multiple of 64 bits. The bitset is allocated in 64-bit
+// words anyway, so this makes every allocated bit addressable. The rounded
+// m is what Cap returns and what is persisted.
+func NewWordAligned(m uint, k uint) *BloomFilter {
+	return New((max(1, m)+63)/64*64, k)
 }
 
 // From creates a new Bloom filter with len(_data_) * 64 bits and _k_ hashing
@@ -53,7 +160,27 @@ func From(data []int64, k uint) *BloomFilter {
 // initialized with the provided data.
 func FromWithM(data []int64, m, k uint) *BloomFilter {
 	k = max(1, k)
-	return &BloomFilter{m, k, fromAtomicBitSet(data, m)}
+	return newFilter(m, k, fromAtomicBitSet(data, m))
+}
+
+// StrictBounds makes f keep every bit past _m_ cleared, so that Count,
+// Equal and Fingerprint only ever see the bits in use. Adds never set those
+// bits, but when m is not a multiple of 64 they can come in with whole
+// words: from From with dirty high bits, or from decoding or merging such a
+// filter. The bits are cleared now, and again after every Merge, union and
+// decode into f. The setting is carried by Copy but is not serialized.
+// Returns the filter (allows chaining)
+func (f *BloomFilter) StrictBounds() *BloomFilter {
+	f.strict = true
+	f.bitset().ClearTrailing()
+	return f
+}
+
+// clearTrailing clears the bits past m if f has StrictBounds.
+func (f *BloomFilter) clearTrailing() {
+	if f.strict {
+		f.bitset().ClearTrailing()
+	}
 }
 
 // baseHashes returns the four hash values of data that are used to create k
@@ -66,7 +193,43 @@ func baseHashes(data []byte) [4]uint64 {
 	}
 }
 
+// BaseHashes returns the four murmur3 hash values of data from which every
+// filter derives the k locations of data, before any salt is mixed in. They
+// can be computed once and passed to AddHash and TestHash of many filters,
+// which apply their own salt: AddHash(BaseHashes(data)) is Add(data).
+func BaseHashes(data []byte) [4]uint64 {
+	return baseHashes(data)
+}
+
+// hashes returns the four hash values of data for this filter: the base
+// hashes, mixed with the salt if the filter has one.
+func (f *BloomFilter) hashes(data []byte) [4]uint64 {
+	return f.salted(baseHashes(data))
+}
+
+// salted mixes the filter's salt, if any, into base hash values. Each value
+// is XORed with the matching hash of the salt and finalized again, so that
+// the salt changes every probe.
+func (f *BloomFilter) salted(h [4]uint64) [4]uint64 {
+	if f.salt == nil {
+		return h
+	}
+	for i := range h {
+		h[i] = fmix64(h[i] ^ f.saltHash[i])
+	}
+	return h
+}
+
 // location returns the ith hashed location using the four base hash values
+//
+// The multiplier h[2+...] cycles with period 4 in i. When m is a power of
+// two, the uint64 wrap-around is invisible modulo m, so probe i and probe
+// i+max(4, m) land on the same bit. Each probe is still uniformly
+// distributed over [0, m), but tiny power-of-two filters get fewer than k
+// distinct bits per key (e.g. New(4, 8) never sets more than 4). Other tiny
+// m show the same tendency to a lesser degree. Such filters are not useful
+// in practice, and changing the scheme would move every bit of existing
+// serialized filters, so the behavior is kept and documented instead.
 func location(h [4]uint64, i uint) uint64 {
 	ii := uint64(i)
 	return h[ii%2] + ii*h[2+(((ii+(ii%2))%4)/2)]
@@ -74,12 +237,34 @@ func location(h [4]uint64, i uint) uint64 {
 
 // location returns the ith hashed location specific to this filter's size
 func (f *BloomFilter) location(h [4]uint64, i uint) uint {
-	return uint(location(h, i) % uint64(f.m))
+	return f.reduce(location(h, i))
+}
+
+// reduce maps a hashed location into [0, m). When m is a power of two the
+// modulo is replaced by a cheaper mask, which yields the same bit.
+func (f *BloomFilter) reduce(x uint64) uint {
+	if f.m&(f.m-1) == 0 {
+		return uint(x & uint64(f.m-1))
+	}
+	return uint(x % uint64(f.m))
+}
+
+// MinBitsForFP returns the number of bits, -n*ln(fp)/(ln 2)^2 rounded up,
+// that a filter needs to hold _n_ items with a false positive rate of _fp_
+// when it uses the optimal number of hash functions. It is the m of
+// EstimateParameters, for sizing memory without constructing a filter:
+// the filter takes about m/8 bytes. Like EstimateParameters, it does not
+// check its inputs.
+func MinBitsForFP(n uint, fp float64) uint {
+	return uint(math.Ceil(-1 * float64(n) * math.Log(fp) / math.Pow(math.Log(2), 2)))
 }
 
 // EstimateParameters estimates requirements for m and k.
+// The inputs are not checked: a tiny p can give an m too large to allocate,
+// or one that overflows uint. Use EstimateParametersChecked for parameters
+// that come from configuration.
 func EstimateParameters(n uint, p float64) (m uint, k uint) {
-	m = uint(math.Ceil(-1 * float64(n) * math.Log(p) / math.Pow(math.Log(2), 2)))
+	m = MinBitsForFP(n, p)
 	k = uint(math.Ceil(math.Log(2) * float64(m) / float64(n)))
 	// Ensure k is at least 1
 	if k < 1 {
@@ -88,6 +273,90 @@ func EstimateParameters(n uint, p float64) (m uint, k uint) {
 	return
 }
 
+// EstimateParametersChecked is EstimateParameters with its inputs checked.
+// It returns an error if p is not strictly between 0 and 1, or if the
+// estimated m exceeds maxM bits or does not fit in a uint, instead of
+// returning parameters for an absurdly large filter; a filter takes m/8
+// bytes. An n of zero is treated as one.
+func EstimateParametersChecked(n uint, p float64, maxM uint) (m uint, k uint, err error) {
+	if !(p > 0 && p < 1) {
+		return 0, 0, fmt.Errorf("invalid false positive rate: %v", p)
+	}
+	n = max(1, n)
+	mf := math.Ceil(-1 * float64(n) * math.Log(p) / math.Pow(math.Log(2), 2))
+	if mf > float64(maxM) || mf >= float64(^uint(0)) {
+		return 0, 0, fmt.Errorf("estimated m of %.0f bits exceeds the maximum of %d", mf, maxM)
+	}
+	m, k = EstimateParameters(n, p)
+	return m, k, nil
+}
+
+// PlanFilter returns everything needed to provision a filter for expectedN
+// items at targetFP false positive rate: the number of bits _m_, rounded up
+// to a whole number of 64-bit words, the number of hashing functions _k_ for
+// that _m_, the size of the bitset in bytes, and the false positive rate
+// the rounded parameters actually give at expectedN items. Because _k_ must
+// be an integer, _m_ may need a few more words than the usual estimate so
+// that actualFP does not exceed targetFP; the smallest such _m_ is found by
+// binary search. A targetFP outside (0, 1), or one that would need more
+// than half the range of uint in bits, yields zeros.
+func PlanFilter(expectedN uint, targetFP float64) (m, k uint, bytes uint, actualFP float64) {
+	n := max(1, expectedN)
+	m, _, err := EstimateParametersChecked(n, targetFP, ^uint(0)/2)
+	if err != nil {
+		return 0, 0, 0, 0
+	}
+	// The best false positive rate for m bits only falls as m grows, so
+	// search the word counts for the smallest one that meets targetFP.
+	fits := func(words uint) bool {
+		return analyticFP(words*64, BestKForM(words*64, n), n) <= targetFP
+	}
+	// The estimate assumes a fractional k, so one word less never fits.
+	lo, hi := (m+63)/64-1, max(1, (m+63)/64)
+	for !fits(hi) {
+		if hi > ^uint(0)/2/64/2 {
+			return 0, 0, 0, 0
+		}
+		lo, hi = hi, hi*2
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if fits(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	m = hi * 64
+	k = BestKForM(m, n)
+	return m, k, m / 8, analyticFP(m, k, n)
+}
+
+// BestKForM returns the number of hashing functions _k_ that gives the
+// lowest false positive rate for a filter of _m_ bits holding _n_ items.
+// It is the inverse of the usual flow, for when _m_ is fixed by memory
+// rather than derived from a target false positive rate. An _n_ of zero is
+// treated as one.
+func BestKForM(m, n uint) uint {
+	if m == 0 {
+		return 1
+	}
+	n = max(1, n)
+	// The optimal k is ln(2)*m/n; pick whichever neighbouring integer
+	// gives the lower false positive rate.
+	k := max(1, uint(math.Log(2)*float64(m)/float64(n)))
+	if analyticFP(m, k+1, n) < analyticFP(m, k, n) {
+		k++
+	}
+	return k
+}
+
+// analyticFP returns the expected false positive rate of a filter with _m_
+// bits and _k_ hashing functions holding _n_ items.
+func analyticFP(m, k, n uint) float64 {
+	return math.Pow(1-math.Exp(-float64(k)*float64(n)/float64(m)), float64(k))
+}
+
 // NewWithEstimates creates a new Bloom filter for about n items with fp
 // false positive rate
 func NewWithEstimates(n uint, fp float64) *BloomFilter {
@@ -95,6 +364,23 @@ func NewWithEstimates(n uint, fp float64) *BloomFilter {
 	return New(m, k)
 }
 
+// NewFixedM creates a new Bloom filter with _m_ bits for about _n_ items,
+// using the number of hashing functions given by BestKForM.
+func NewFixedM(m uint, n uint) *BloomFilter {
+	return New(m, BestKForM(m, n))
+}
+
+// NewFromStrings creates a new Bloom filter sized for len(items) items at fp
+// false positive rate, and adds every item to it. An empty items gets a
+// filter sized for one item.
+func NewFromStrings(items []string, fp float64) *BloomFilter {
+	f := NewWithEstimates(max(1, uint(len(items))), fp)
+	for _, item := range items {
+		f.AddString(item)
+	}
+	return f
+}
+
 // Cap returns the capacity, _m_, of a Bloom filter
 func (f *BloomFilter) Cap() uint {
 	return f.m
@@ -107,105 +393,751 @@ func (f *BloomFilter) K() uint {
 
 // BitSet returns the underlying atomic bitset for this filter.
 func (f *BloomFilter) BitSet() *atomicBitSet {
-	return f.b
+	return f.bitset()
+}
+
+// NumWords returns the number of 64-bit words holding the filter's bits,
+// (m+63)/64. Bit i is stored in word i/64 as the mask 1<<(i%64), the layout
+// of every serialized format.
+func (f *BloomFilter) NumWords() int {
+	return f.bitset().NumWords()
+}
+
+// WordAt returns word i of the filter's bits, for paging a filter out to a
+// store word by word. Each word is loaded atomically, but a filter written
+// to while it is paged out is read as described for Merge. Returns 0 if i
+// is out of range, as Test does for bits.
+func (f *BloomFilter) WordAt(i int) uint64 {
+	return f.bitset().WordAt(i)
+}
+
+// SetWordAt replaces word i of the filter's bits with v, for reconstructing
+// a filter paged out with WordAt. The store is atomic, but it overwrites
+// the word, so an Add racing with it may lose bits; page words into a
+// filter that is not yet in use. Bits past m are ignored, and an
+// out-of-range i does nothing.
+func (f *BloomFilter) SetWordAt(i int, v uint64) {
+	f.bitset().SetWordAt(i, v)
+}
+
+// bitset atomically loads the filter's bitset. Methods load it once per call
+// so that SwapBitSet can replace it while the filter is in use without any
+// single operation touching both the old and the new bitset.
+func (f *BloomFilter) bitset() *atomicBitSet {
+	return (*atomicBitSet)(atomic.LoadPointer(f.bitsetPtr()))
+}
+
+// storeBitSet atomically installs b as the filter's bitset.
+func (f *BloomFilter) storeBitSet(b *atomicBitSet) {
+	atomic.StorePointer(f.bitsetPtr(), unsafe.Pointer(b))
+}
+
+// bitsetPtr returns the address of the bitset field for the atomic
+// functions. The field is a plain pointer rather than an atomic.Pointer so
+// that a BloomFilter can still be copied, e.g. to marshal it by value.
+func (f *BloomFilter) bitsetPtr() *unsafe.Pointer {
+	return (*unsafe.Pointer)(unsafe.Pointer(&f.b))
+}
+
+// SwapBitSet atomically replaces the filter's bitset with b and returns the
+// previous one. b must have the same size as the current bitset, e.g. the
+// BitSet of a filter built offline with the same m and k. Concurrent
+// operations see either the old or the new bitset in full, never a mix;
+// an Add racing with the swap may land in the old bitset only.
+func (f *BloomFilter) SwapBitSet(b *atomicBitSet) (old *atomicBitSet, err error) {
+	cur := f.bitset()
+	if b == nil || b.size != cur.size || len(b.data) != len(cur.data) {
+		return nil, fmt.Errorf("bitset size doesn't match: want %d bits", cur.size)
+	}
+	// Replacing the contents is a mutation of the filter.
+	b.markDirty()
+	if f.strict {
+		b.ClearTrailing()
+	}
+	return (*atomicBitSet)(atomic.SwapPointer(f.bitsetPtr(), unsafe.Pointer(b))), nil
+}
+
+// Refresh replaces the filter's contents with exactly items. The items are
+// added to a fresh bitset, which is then installed with SwapBitSet, so each
+// operation sees either the previous contents or all of items, never a
+// partially rebuilt filter. Adds racing with the swap may be lost, and a
+// callback registered with OnFillThreshold is dropped with the old bitset.
+// Returns the filter (allows chaining)
+func (f *BloomFilter) Refresh(items [][]byte) *BloomFilter {
+	g := NewWithSalt(f.m, f.k, f.salt).AddBatch(items)
+	// g has the same m, so the swap cannot fail.
+	_, _ = f.SwapBitSet(g.bitset())
+	return f
+}
+
+// Double returns a new filter with twice the bits of f, holding items.
+// Bloom filters cannot enumerate their items, so items must be the complete
+// set that f was built from. The number of hashing functions is recomputed
+// for the new size and len(items) with BestKForM, rather than kept, since
+// the best _k_ grows with _m_; the salt is carried over. f is unchanged.
+func (f *BloomFilter) Double(items [][]byte) *BloomFilter {
+	m := 2 * f.m
+	return NewWithSalt(m, BestKForM(m, uint(len(items))), f.salt).AddBatch(items)
 }
 
 // Add data to the Bloom Filter. Returns the filter (allows chaining)
 func (f *BloomFilter) Add(data []byte) *BloomFilter {
-	h := baseHashes(data)
-	for i := uint(0); i < f.k; i++ {
-		f.b.Set(f.location(h, i))
-	}
+	f.AddN(data)
 	return f
 }
 
-// Add precomputed hash values to the Bloom Filter. Returns the filter (allows chaining)
+// AddN adds data to the Bloom Filter and returns the number of adds
+// performed on the filter so far, including this one. See TotalAdds.
+func (f *BloomFilter) AddN(data []byte) uint64 {
+	b := f.bitset()
+	h := f.hashes(data)
+	if f.k == 1 {
+		// location(h, 0) is h[0]; skip the probe loop.
+		b.Set(f.reduce(h[0]))
+	} else {
+		for i := uint(0); i < f.k; i++ {
+			b.Set(f.location(h, i))
+		}
+	}
+	return b.adds.Add(1)
+}
+
+// TotalAdds returns the number of add operations performed on the filter:
+// every call to Add, AddN, AddHash, AddLocations, AddCounting, TestAndAdd,
+// TestAndAddDetailed and TestOrAdd counts, including repeated adds of the
+// same item, so it tracks attempts rather than distinct items. The counter
+// belongs to the bitset: a Copy or a decoded filter starts from zero, and
+// Refresh and SwapBitSet replace it along with the bits.
+func (f *BloomFilter) TotalAdds() uint64 {
+	return f.bitset().adds.Load()
+}
+
+// Add precomputed hash values, as returned by BaseHashes, to the Bloom
+// Filter. Returns the filter (allows chaining)
 func (f *BloomFilter) AddHash(h [4]uint64) *BloomFilter {
+	b := f.bitset()
+	h = f.salted(h)
 	for i := uint(0); i < f.k; i++ {
-		f.b.Set(f.location(h, i))
+		b.Set(f.location(h, i))
+	}
+	b.adds.Add(1)
+	return f
+}
+
+// OnFillThreshold registers cb to be called once, the first time an add
+// brings the fill ratio (bits set / m) to at least ratio. It replaces any
+// callback registered earlier; a nil cb removes it.
+//
+// To keep adds cheap the filter does not rescan its bits: it counts the
+// bits each add newly sets, starting from the count at registration. The
+// callback therefore fires during the add that sets the threshold bit, on
+// the goroutine running that add, and it should return quickly. Bits set
+// by Merge, UnionInto, ApplyDelta and MergeFromReaders are counted as well,
+// so a merge that crosses ratio fires cb on the merging goroutine, and
+// SetWordAt counts both the bits it sets and the bits it clears. ClearAll
+// restarts the count from zero, and a bitset installed with SwapBitSet or
+// by a decode starts without a callback. If the filter is already past
+// ratio, cb fires on the next add that sets a new bit.
+func (f *BloomFilter) OnFillThreshold(ratio float64, cb func()) {
+	b := f.bitset()
+	if cb == nil {
+		b.watch.Store(nil)
+		return
+	}
+	w := &fillWatch{threshold: int64(math.Ceil(ratio * float64(f.m))), cb: cb}
+	w.set.Store(int64(b.Count()))
+	b.watch.Store(w)
+}
+
+// AddBatch adds every item to the Bloom Filter. Returns the filter (allows
+// chaining)
+func (f *BloomFilter) AddBatch(items [][]byte) *BloomFilter {
+	if f.tracer != nil {
+		defer f.traceSpan("AddBatch", time.Now(), len(items), nil, nil)
+	}
+	for _, item := range items {
+		f.Add(item)
+	}
+	return f
+}
+
+// AddAllDeduped adds every item to the Bloom Filter, hashing each distinct
+// item only once. It tracks the items seen so far in a map, which holds a
+// copy of every distinct item for the duration of the call, so it uses
+// memory proportional to the total size of the distinct items. This pays
+// off only when items repeat often; otherwise prefer AddBatch. Returns the
+// filter (allows chaining)
+func (f *BloomFilter) AddAllDeduped(items [][]byte) *BloomFilter {
+	seen := make(map[string]struct{})
+	for _, item := range items {
+		if _, ok := seen[string(item)]; ok {
+			continue
+		}
+		seen[string(item)] = struct{}{}
+		f.Add(item)
 	}
 	return f
 }
 
-// Merge the data from another Bloom Filter. Returns error if parameters don't match.
-func (f *BloomFilter) Merge(g *BloomFilter) error {
+// AddLocations sets the bit at each location modulo _m_, as computed by
+// Locations. It is the counterpart of TestLocations. Returns the filter
+// (allows chaining)
+func (f *BloomFilter) AddLocations(locs []uint64) *BloomFilter {
+	b := f.bitset()
+	for _, loc := range locs {
+		b.Set(f.reduce(loc))
+	}
+	b.adds.Add(1)
+	return f
+}
+
+// AddCounting adds data to the Bloom Filter and returns how many of its k bits
+// were newly set (flipped from 0 to 1) by this call. Summing the result over
+// all adds gives the exact number of set bits without rescanning the filter.
+//
+// Each probe uses the bitset's TestAndSet, which compiles to a
+// compare-and-swap loop rather than a single locked OR on most platforms, so
+// AddCounting is somewhat slower than Add under contention.
+func (f *BloomFilter) AddCounting(data []byte) (newBits int) {
+	b := f.bitset()
+	h := f.hashes(data)
+	for i := uint(0); i < f.k; i++ {
+		if !b.TestAndSet(f.location(h, i)) {
+			newBits++
+		}
+	}
+	b.adds.Add(1)
+	return newBits
+}
+
+// Merge the data from another Bloom Filter. Returns a *ParamMismatch error if
+// parameters don't match.
+//
+// Merge is safe while g is being written to. Words of g are read one at a
+// time, so the merged bits are not a single point-in-time view of g, but
+// because adds only ever set bits, every Add on g that completed before
+// Merge started is fully present afterwards, and Adds running concurrently
+// may be partially present. Taking a Copy of g first gives no stronger
+// guarantee, since Copy reads g the same way.
+func (f *BloomFilter) Merge(g *BloomFilter) (err error) {
+	if f.tracer != nil {
+		defer f.traceSpan("Merge", time.Now(), 0, nil, &err)
+	}
+	if err := f.compatible(g); err != nil {
+		return err
+	}
+
+	f.bitset().InPlaceUnion(g.bitset())
+	f.clearTrailing()
+	return nil
+}
+
+// MergeUnsafe is Merge using plain, non-atomic loads and stores, which is
+// several times faster for large filters. It is unsafe under concurrency:
+// nothing else may use f, and nothing may write to g, until it returns,
+// e.g. when combining shards offline before publishing the result.
+func (f *BloomFilter) MergeUnsafe(g *BloomFilter) error {
+	if err := f.compatible(g); err != nil {
+		return err
+	}
+
+	f.bitset().InPlaceUnionUnsafe(g.bitset())
+	f.clearTrailing()
+	return nil
+}
+
+// MergeIfUnderFP merges g into f only if the merged filter's estimated false
+// positive rate, (bits set / m)^k, would not exceed targetFP. The projection
+// counts the bits of the union without building it. Returns whether the
+// merge happened, or an error if the parameters don't match.
+func (f *BloomFilter) MergeIfUnderFP(g *BloomFilter, targetFP float64) (merged bool, err error) {
+	if err := f.compatible(g); err != nil {
+		return false, err
+	}
+	b, gb := f.bitset(), g.bitset()
+	fill := float64(b.UnionCount(gb)) / float64(f.m)
+	if math.Pow(fill, float64(f.k)) > targetFP {
+		return false, nil
+	}
+	b.InPlaceUnion(gb)
+	f.clearTrailing()
+	return true, nil
+}
+
+// MergeRehash merges g into f when their k or salt differ, which places
+// the same item at different bits so that Merge cannot OR the bitsets.
+// Instead it re-adds gItems, the items g was built from, with f's own
+// hashing; g is only checked for a matching m. Returns a *ParamMismatch
+// error if m differs.
+func (f *BloomFilter) MergeRehash(g *BloomFilter, gItems [][]byte) error {
 	if f.m != g.m {
-		return fmt.Errorf("m's don't match: %d != %d", f.m, g.m)
+		return &ParamMismatch{Field: FieldM, Expected: f.m, Got: g.m}
 	}
-	if f.k != g.k {
-		return fmt.Errorf("k's don't match: %d != %d", f.k, g.k) // Corrected error message
+	f.AddBatch(gItems)
+	return nil
+}
+
+// UnionCount returns the number of bits set in the union of f and g, i.e.
+// what Count would return after f.Merge(g), without allocating or
+// modifying either filter. Returns a *ParamMismatch error if the parameters
+// don't match.
+func (f *BloomFilter) UnionCount(g *BloomFilter) (uint, error) {
+	if err := f.compatible(g); err != nil {
+		return 0, err
 	}
+	return f.bitset().UnionCount(g.bitset()), nil
+}
+
+// FilterDiff compares the bits of two filters, see Diff.
+type FilterDiff struct {
+	OnlyF   uint // Bits set in f but not in g
+	OnlyG   uint // Bits set in g but not in f
+	Both    uint // Bits set in both
+	Hamming uint // Bits that differ, OnlyF + OnlyG
+}
 
-	f.b.InPlaceUnion(g.b)
+// Diff compares the bits of f and g, for debugging how far a replica g has
+// diverged from its primary f: a replica that is only lagging has OnlyF
+// bits alone, while OnlyG bits are bits the primary lacks, which point to
+// corruption or to writes lost on the primary.
+// Words are read one at a time, as in Merge. Returns a *ParamMismatch
+// error if the parameters don't match.
+func (f *BloomFilter) Diff(g *BloomFilter) (FilterDiff, error) {
+	if err := f.compatible(g); err != nil {
+		return FilterDiff{}, err
+	}
+	b, gb := f.bitset(), g.bitset()
+	var d FilterDiff
+	for i := range b.data {
+		x, y := uint64(b.data[i].Load()), uint64(gb.data[i].Load())
+		d.OnlyF += uint(bits.OnesCount64(x &^ y))
+		d.OnlyG += uint(bits.OnesCount64(y &^ x))
+		d.Both += uint(bits.OnesCount64(x & y))
+	}
+	d.Hamming = d.OnlyF + d.OnlyG
+	return d, nil
+}
+
+// UnionInto stores the union of a and b into dst, overwriting its previous
+// contents without allocating. All three filters must have the same m and k;
+// dst may be a or b.
+func UnionInto(a, b, dst *BloomFilter) error {
+	if err := dst.compatible(a); err != nil {
+		return err
+	}
+	if err := dst.compatible(b); err != nil {
+		return err
+	}
+	dst.bitset().StoreUnion(a.bitset(), b.bitset())
+	dst.clearTrailing()
+	return nil
+}
+
+// SymmetricDifference returns a new filter holding the bits set in exactly
+// one of f and g. Bits set in both cancel out, so the result is not a filter
+// of any set of items; it is meant for comparing bit patterns, for instance
+// counting how far two replicas have drifted apart. Returns an error if the
+// parameters don't match.
+func (f *BloomFilter) SymmetricDifference(g *BloomFilter) (*BloomFilter, error) {
+	if err := f.compatible(g); err != nil {
+		return nil, err
+	}
+	d := f.Copy()
+	d.bitset().InPlaceSymmetricDifference(g.bitset())
+	d.clearTrailing()
+	return d, nil
+}
+
+// EstimateUnionFillRatio returns the fill ratio (bits set / m) the union of
+// filters would have, counting the OR of their words one word at a time
+// without building the union. It does not allocate for up to 8 filters.
+// Returns an error if filters is empty or if their parameters don't match.
+func EstimateUnionFillRatio(filters []*BloomFilter) (float64, error) {
+	if len(filters) == 0 {
+		return 0, fmt.Errorf("no filters")
+	}
+	first := filters[0]
+	// Load each bitset once; up to 8 of them fit without allocating.
+	var buf [8]*atomicBitSet
+	bitsets := buf[:0]
+	for _, f := range filters {
+		if err := first.compatible(f); err != nil {
+			return 0, err
+		}
+		bitsets = append(bitsets, f.bitset())
+	}
+	var count uint
+	for i := range bitsets[0].data {
+		var w int64
+		for _, b := range bitsets {
+			w |= b.data[i].Load()
+		}
+		count += uint(bits.OnesCount64(uint64(w)))
+	}
+	return float64(count) / float64(first.m), nil
+}
+
+// Mergeable returns true if g can be merged into f, i.e. Merge would not
+// return an error.
+func (f *BloomFilter) Mergeable(g *BloomFilter) bool {
+	return f.compatible(g) == nil
+}
+
+// ParamField identifies a parameter that must match between two filters.
+type ParamField int
+
+// Parameters compared by Merge and the other operations combining filters.
+const (
+	FieldM    ParamField = iota + 1 // Number of bits
+	FieldK                          // Number of hash functions
+	FieldSalt                       // Salt, see NewWithSalt
+)
+
+// String returns the parameter name.
+func (p ParamField) String() string {
+	switch p {
+	case FieldM:
+		return "m"
+	case FieldK:
+		return "k"
+	case FieldSalt:
+		return "salt"
+	}
+	return fmt.Sprintf("ParamField(%d)", int(p))
+}
+
+// ParamMismatch is the error returned by Merge and the other operations
+// combining two filters when their parameters differ. Expected is the
+// receiver's value and Got the argument's; both are zero for FieldSalt,
+// whose values are the filters' Salt.
+type ParamMismatch struct {
+	Field    ParamField
+	Expected uint
+	Got      uint
+}
+
+func (e *ParamMismatch) Error() string {
+	if e.Field == FieldSalt {
+		return "salts don't match"
+	}
+	return fmt.Sprintf("%v's don't match: %d != %d", e.Field, e.Expected, e.Got)
+}
+
+// compatible returns a *ParamMismatch for the first parameter that differs
+// between f and g, or nil if their bitsets can be combined.
+func (f *BloomFilter) compatible(g *BloomFilter) error {
+	if f.m != g.m {
+		return &ParamMismatch{Field: FieldM, Expected: f.m, Got: g.m}
+	}
+	if f.k != g.k {
+		return &ParamMismatch{Field: FieldK, Expected: f.k, Got: g.k}
+	}
+	if !bytes.Equal(f.salt, g.salt) {
+		return &ParamMismatch{Field: FieldSalt}
+	}
 	return nil
 }
 
 // Copy creates a copy of a Bloom filter.
 func (f *BloomFilter) Copy() *BloomFilter {
-	fc := New(f.m, f.k)
-	// Manually copy the bitset data for a deep copy
-	for i := range f.b.data {
-		fc.b.data[i].Store(f.b.data[i].Load())
+	fc := NewWithSalt(f.m, f.k, f.salt)
+	b := f.bitset()
+	// Manually copy the bitset data for a deep copy. Both bitsets are sized
+	// from m, so the word counts agree; the bound only guards against a
+	// mismatch ever turning into an index panic.
+	cb := fc.bitset()
+	for i := 0; i < len(b.data) && i < len(cb.data); i++ {
+		cb.data[i].Store(b.data[i].Load())
 	}
+	cb.syncNonEmpty()
+	fc.strict = f.strict
 	return fc
 }
 
 // AddString adds a string to the Bloom Filter.
 func (f *BloomFilter) AddString(data string) *BloomFilter {
+	if f.cache != nil {
+		return f.AddHash(f.cache.hashes(data))
+	}
 	return f.Add([]byte(data))
 }
 
+// AddStringUnsafe adds a string to the Bloom Filter without copying it to
+// a byte slice. The string bytes are viewed in place through package
+// unsafe; this is sound because hashing only reads them. Recent compilers
+// already elide the copy in AddString when they can prove the bytes are
+// not retained, so prefer AddString unless profiles show the conversion.
+func (f *BloomFilter) AddStringUnsafe(data string) *BloomFilter {
+	return f.Add(unsafeBytes(data))
+}
+
+// unsafeBytes returns a read-only view of the bytes of s. The result must
+// never be written to.
+func unsafeBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
 // Test returns true if the data is *probably* in the BloomFilter, false otherwise.
+//
+// The k bits are loaded one at a time, so a Test running concurrently with
+// an Add of the same data may see only some of its bits and return false.
+// Bits are only ever set (short of ClearAll), so this is the only effect:
+// once an Add has returned, every later Test of that data returns true, and
+// once a Test has returned true, every later Test does too.
 func (f *BloomFilter) Test(data []byte) bool {
-	h := baseHashes(data)
+	b := f.bitset()
+	h := f.hashes(data)
+	if f.k == 1 {
+		// location(h, 0) is h[0]; skip the probe loop.
+		return b.Test(f.reduce(h[0]))
+	}
 	for i := uint(0); i < f.k; i++ {
-		if !f.b.Test(f.location(h, i)) {
+		if !b.Test(f.location(h, i)) {
 			return false
 		}
 	}
 	return true
 }
 
-// TestHash returns true if the hash is *probably* in the BloomFilter.
+// TestProbes is Test, also returning the number of bits it checked before
+// answering: k when data is probably present, and the position of the first
+// unset bit, between 1 and k, when it is definitely not. Averaged over a
+// workload this is the lookup cost that short-circuiting on negatives saves.
+func (f *BloomFilter) TestProbes(data []byte) (present bool, probes int) {
+	b := f.bitset()
+	h := f.hashes(data)
+	for i := uint(0); i < f.k; i++ {
+		if !b.Test(f.location(h, i)) {
+			return false, int(i) + 1
+		}
+	}
+	return true, int(f.k)
+}
+
+// IsLikelyNew returns true if data is definitely not in the BloomFilter,
+// and false if it probably is, i.e. it is !Test(data). It is tuned for
+// streams where most items are new: it first computes only the first two
+// of the four base hashes and checks the first probe. Only if that bit is
+// set does it finish the hashing, reusing the work done so far, and check
+// the remaining probes.
+func (f *BloomFilter) IsLikelyNew(data []byte) bool {
+	b := f.bitset()
+	var d Digest128
+	var h [4]uint64
+	h[0], h[1] = d.sumFirst128(data)
+	// location(h, 0) is h[0], which the salt mixes independently of the
+	// other hashes.
+	if !b.Test(f.reduce(f.salted(h)[0])) {
+		return true
+	}
+	h[2], h[3] = d.sumSecond128(data)
+	h = f.salted(h)
+	for i := uint(1); i < f.k; i++ {
+		if !b.Test(f.location(h, i)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains is an alias of Test.
+func (f *BloomFilter) Contains(data []byte) bool {
+	return f.Test(data)
+}
+
+// TestAll returns true if every item is *probably* in the BloomFilter.
+// It stops at the first item that is definitely absent.
+func (f *BloomFilter) TestAll(items [][]byte) bool {
+	for _, item := range items {
+		if !f.Test(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestAny returns true if at least one item is *probably* in the BloomFilter.
+// It stops at the first item that is probably present.
+func (f *BloomFilter) TestAny(items [][]byte) bool {
+	for _, item := range items {
+		if f.Test(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestHash returns true if the hash values, as returned by BaseHashes, are
+// *probably* in the BloomFilter.
 func (f *BloomFilter) TestHash(h [4]uint64) bool {
+	b := f.bitset()
+	h = f.salted(h)
 	for i := uint(0); i < f.k; i++ {
-		if !f.b.Test(f.location(h, i)) {
+		if !b.Test(f.location(h, i)) {
 			return false
 		}
 	}
 	return true
 }
 
+// TestAcrossAny returns true if data is *probably* in at least one of the
+// filters, stopping at the first hit. The key is hashed once and the hashes
+// are tested against each filter with its own _m_ and _k_, so the filters
+// do not need to share parameters.
+func TestAcrossAny(filters []*BloomFilter, data []byte) bool {
+	h := baseHashes(data) // salted by each filter's TestHash
+	for _, f := range filters {
+		if f.TestHash(h) {
+			return true
+		}
+	}
+	return false
+}
+
 // TestString returns true if the string is *probably* in the BloomFilter.
 func (f *BloomFilter) TestString(data string) bool {
+	if f.cache != nil {
+		return f.TestHash(f.cache.hashes(data))
+	}
 	return f.Test([]byte(data))
 }
 
+// TestStringUnsafe is TestString without copying the string to a byte
+// slice. See AddStringUnsafe.
+func (f *BloomFilter) TestStringUnsafe(data string) bool {
+	return f.Test(unsafeBytes(data))
+}
+
+// AddUint64 adds x to the Bloom Filter, encoded as 8 big-endian bytes. It
+// is Add(binary.BigEndian.AppendUint64(nil, x)) without the allocation: the
+// bytes are encoded into a buffer on the stack, so it is safe for
+// concurrent use.
+func (f *BloomFilter) AddUint64(x uint64) *BloomFilter {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	return f.Add(buf[:])
+}
+
+// TestUint64 returns true if x is *probably* in the BloomFilter. See
+// AddUint64.
+func (f *BloomFilter) TestUint64(x uint64) bool {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	return f.Test(buf[:])
+}
+
+// AddStream adds the bytes read from r up to io.EOF as a single item, the
+// same item as Add with all of them. They are hashed as they are read, so
+// large keys such as file contents need not fit in memory. Nothing is added
+// if reading fails.
+func (f *BloomFilter) AddStream(r io.Reader) error {
+	var d Digest128
+	h, err := d.sum256Reader(r)
+	if err != nil {
+		return err
+	}
+	f.AddHash(h)
+	return nil
+}
+
+// TestStream returns true if the bytes read from r up to io.EOF are
+// *probably* in the BloomFilter. See AddStream.
+func (f *BloomFilter) TestStream(r io.Reader) (bool, error) {
+	var d Digest128
+	h, err := d.sum256Reader(r)
+	if err != nil {
+		return false, err
+	}
+	return f.TestHash(h), nil
+}
+
+// TestReaderTo reads keys from r, one per line, and writes to w a line with
+// "1" for every key that is *probably* in the BloomFilter and "0" for every
+// other key, in input order. Line endings ("\n" or "\r\n") are not part of
+// the keys. Output is buffered and written as input is read, so arbitrarily
+// large inputs can be piped through.
+func (f *BloomFilter) TestReaderTo(r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, math.MaxInt)
+	out := bufio.NewWriter(w)
+	for scanner.Scan() {
+		result := byte('0')
+		if f.Test(scanner.Bytes()) {
+			result = '1'
+		}
+		if _, err := out.Write([]byte{result, '\n'}); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
 // TestLocations returns true if all locations are set in the BloomFilter.
 func (f *BloomFilter) TestLocations(locs []uint64) bool {
+	b := f.bitset()
 	for _, loc := range locs {
-		if !f.b.Test(uint(loc % uint64(f.m))) {
+		if !b.Test(f.reduce(loc)) {
 			return false
 		}
 	}
 	return true
 }
 
+// TestLocationsBatch calls TestLocations for the locations of every key, as
+// computed by Locations, and returns whether each is *probably* in the
+// BloomFilter. Since TestLocations reduces modulo _m_, the same locations
+// can be checked against filters of any size that share k.
+func (f *BloomFilter) TestLocationsBatch(keys [][]uint64) []bool {
+	b := f.bitset()
+	present := make([]bool, len(keys))
+	for i, locs := range keys {
+		present[i] = true
+		for _, loc := range locs {
+			if !b.Test(f.reduce(loc)) {
+				present[i] = false
+				break
+			}
+		}
+	}
+	return present
+}
+
 // TestAndAdd checks membership and adds the data unconditionally.
 // Returns true if the element was *probably* present before adding.
 func (f *BloomFilter) TestAndAdd(data []byte) bool {
+	b := f.bitset()
 	present := true
-	h := baseHashes(data)
+	h := f.hashes(data)
 	for i := uint(0); i < f.k; i++ {
 		l := f.location(h, i)
-		if !f.b.Test(l) {
+		if !b.Test(l) {
 			present = false
 		}
-		f.b.Set(l) // Set the bit regardless
+		b.Set(l) // Set the bit regardless
 	}
+	b.adds.Add(1)
 	return present
 }
 
+// TestAndAddDetailed is like TestAndAdd but also reports how many of the
+// k bits of data were already set before the add. A value strictly between
+// 0 and k means the item partially collided with earlier items. If two of
+// the item's own probes hit the same bit, the second one counts as set.
+func (f *BloomFilter) TestAndAddDetailed(data []byte) (present bool, alreadySet int) {
+	b := f.bitset()
+	h := f.hashes(data)
+	for i := uint(0); i < f.k; i++ {
+		if b.TestAndSet(f.location(h, i)) {
+			alreadySet++
+		}
+	}
+	b.adds.Add(1)
+	return uint(alreadySet) == f.k, alreadySet
+}
+
 // TestAndAddString is the string version of TestAndAdd.
 func (f *BloomFilter) TestAndAddString(data string) bool {
 	return f.TestAndAdd([]byte(data))
@@ -217,15 +1149,29 @@ func (f *BloomFilter) TestAndAddString(data string) bool {
 // bits being present beforehand if run concurrently. It ensures each bit
 // is set if it wasn't already.
 func (f *BloomFilter) TestOrAdd(data []byte) bool {
+	b := f.bitset()
 	present := true
-	h := baseHashes(data)
+	h := f.hashes(data)
 	for i := uint(0); i < f.k; i++ {
 		l := f.location(h, i)
-		if !f.b.Test(l) {
+		if !b.Test(l) {
 			present = false
-			f.b.Set(l) // Set the bit if not present
+			b.Set(l) // Set the bit if not present
 		}
 	}
+	b.adds.Add(1)
+	return present
+}
+
+// TestOrAddBatch calls TestOrAdd for every item, in order, and returns
+// whether each was *probably* present before it was added. An item repeated
+// within the batch is reported present from its second occurrence on. The
+// concurrency note of TestOrAdd applies to each item.
+func (f *BloomFilter) TestOrAddBatch(items [][]byte) []bool {
+	present := make([]bool, len(items))
+	for i, item := range items {
+		present[i] = f.TestOrAdd(item)
+	}
 	return present
 }
 
@@ -234,21 +1180,78 @@ func (f *BloomFilter) TestOrAddString(data string) bool {
 	return f.TestOrAdd([]byte(data))
 }
 
+// IsDirty returns true if the filter was mutated since it was created or
+// loaded, or since the last MarkClean. Every operation that may change the
+// bits (adds, merges, ClearAll, SwapBitSet, ApplyDelta...) sets the flag at
+// the cost of one atomic load, plus one store the first time.
+func (f *BloomFilter) IsDirty() bool {
+	return f.bitset().IsDirty()
+}
+
+// MarkClean clears the dirty flag, typically right before saving the
+// filter. A mutation concurrent with the save then leaves the filter dirty
+// for the next save.
+func (f *BloomFilter) MarkClean() {
+	f.bitset().MarkClean()
+}
+
+// IsEmpty returns true if nothing has been added to the filter since it was
+// created or last cleared, in constant time. It is monotone: once an item
+// has been added, IsEmpty stays false until ClearAll or ClearAllSync.
+func (f *BloomFilter) IsEmpty() bool {
+	return f.bitset().IsEmpty()
+}
+
 // ClearAll clears all the data in a Bloom filter.
+//
+// ClearAll is safe to call concurrently with Add and Test, but it is not a
+// barrier: words are zeroed one at a time, so an Add that runs concurrently
+// with ClearAll may or may not be visible once it returns. What is
+// guaranteed is that no bit set before ClearAll started survives unless a
+// concurrent Add sets it again, and that every Add which starts after
+// ClearAll returns is visible to later Tests.
 func (f *BloomFilter) ClearAll() *BloomFilter {
-	f.b.ClearAll()
+	f.bitset().ClearAll()
+	return f
+}
+
+// ClearAllSync clears all the data in a Bloom filter with the same guarantees
+// as ClearAll, but is additionally serialized against Merge and other
+// ClearAllSync calls. A concurrent Merge therefore lands either entirely
+// before the clear (and is erased) or entirely after it, never half and half.
+// Plain Adds are not blocked.
+func (f *BloomFilter) ClearAllSync() *BloomFilter {
+	f.bitset().ClearAllSync()
 	return f
 }
 
 // EstimateFalsePositiveRate estimates the empirical false positive rate.
-// Uses a temporary filter.
+// Uses a temporary filter. The result is always in [0, 1]: like New, an _m_
+// or _k_ of zero is treated as one, and _n_ is capped so that the keys
+// added and the keys tested stay distinct 32-bit values. Once every bit is
+// set the rate is 1 and no more keys are added, so a huge _n_ returns
+// quickly.
 func EstimateFalsePositiveRate(m, k, n uint) (fpRate float64) {
 	rounds := uint32(100000)
+	if limit := uint(math.MaxUint32 - rounds); n > limit {
+		n = limit
+	}
 	f := New(m, k) // Uses the new atomic-backed filter
+	// Check for a full filter about once per m adds, which keeps the cost
+	// of counting bits negligible next to the adds.
+	checkEvery := uint32(1024)
+	if f.m >= math.MaxUint32 {
+		checkEvery = math.MaxUint32
+	} else if f.m > 1024 {
+		checkEvery = uint32(f.m)
+	}
 	n1 := make([]byte, 4)
 	for i := uint32(0); i < uint32(n); i++ {
 		binary.BigEndian.PutUint32(n1, i)
 		f.Add(n1)
+		if (i+1)%checkEvery == 0 && f.bitset().Count() == f.m {
+			return 1
+		}
 	}
 	fp := 0
 	for i := uint32(0); i < rounds; i++ {
@@ -261,11 +1264,41 @@ func EstimateFalsePositiveRate(m, k, n uint) (fpRate float64) {
 	return
 }
 
+// MeasureFalsePositiveRate returns the fraction of knownAbsent that tests
+// positive against the current state of the filter. Every key of the sample
+// must be known not to have been added, so that each hit is a false
+// positive. Unlike EstimateFalsePositiveRate, which fills a temporary
+// filter with synthetic integer keys, this measures the filter as it is on
+// real keys; a rate well above the expected (Count()/Cap())^K() points to
+// keys the hashing spreads poorly. An empty sample returns 0.
+func (f *BloomFilter) MeasureFalsePositiveRate(knownAbsent [][]byte) float64 {
+	if len(knownAbsent) == 0 {
+		return 0
+	}
+	fp := 0
+	for _, data := range knownAbsent {
+		if f.Test(data) {
+			fp++
+		}
+	}
+	return float64(fp) / float64(len(knownAbsent))
+}
+
+// Count returns the number of bits set in the filter.
+func (f *BloomFilter) Count() uint {
+	return f.bitset().Count()
+}
+
 // ApproximatedSize estimates the number of items added to the filter.
 func (f *BloomFilter) ApproximatedSize() int64 {
+	return f.approximatedSize(f.bitset().Count())
+}
+
+// approximatedSize estimates the number of items from a count of set bits.
+func (f *BloomFilter) approximatedSize(count uint) int64 {
 	m := float64(f.Cap())
 	k := float64(f.K())
-	x := float64(f.b.Count())       // Use the Count method of atomicBitSet
+	x := float64(count)
 	if m == 0 || k == 0 || m == x { // Avoid division by zero or log(0)
 		// Cannot estimate, or filter is full.
 		// Returning 0 or an indicator might be appropriate.
@@ -281,16 +1314,139 @@ func (f *BloomFilter) ApproximatedSize() int64 {
 	return int64(-m / k * math.Log(1-x/m))
 }
 
+// EstimateUnionSize estimates the number of distinct items in the union of
+// f and g from the bits set in either, as ApproximatedSize does for one
+// filter, without building the union. Returns a *ParamMismatch error if the
+// parameters don't match.
+func (f *BloomFilter) EstimateUnionSize(g *BloomFilter) (int64, error) {
+	if err := f.compatible(g); err != nil {
+		return 0, err
+	}
+	return f.approximatedSize(f.bitset().UnionCount(g.bitset())), nil
+}
+
+// EstimateIntersectionSize estimates the number of distinct items added to
+// both f and g as |f| + |g| - |f ∪ g|, from ApproximatedSize and
+// EstimateUnionSize; negative estimates are reported as 0. Returns a
+// *ParamMismatch error if the parameters don't match.
+//
+// The estimate is the difference of larger estimates, so its absolute error
+// is about that of the union estimate: a few percent of the union while the
+// union fills well under half of the bits, growing quickly beyond that as
+// each set bit carries less information. Once every bit is set it is
+// meaningless. Small intersections of large sets therefore have a large
+// relative error.
+func (f *BloomFilter) EstimateIntersectionSize(g *BloomFilter) (int64, error) {
+	if err := f.compatible(g); err != nil {
+		return 0, err
+	}
+	b, gb := f.bitset(), g.bitset()
+	n := f.approximatedSize(b.Count()) + f.approximatedSize(gb.Count()) - f.approximatedSize(b.UnionCount(gb))
+	if n < 0 {
+		return 0, nil
+	}
+	return n, nil
+}
+
+// BitsPerElement returns the number of bits per item, m divided by the
+// estimated number of items (see ApproximatedSize). It returns 0 for a
+// filter with no estimated items. Compare it with BitsPerElementFor the
+// target false positive rate to check the provisioning.
+func (f *BloomFilter) BitsPerElement() float64 {
+	n := f.ApproximatedSize()
+	if n <= 0 {
+		return 0
+	}
+	return float64(f.m) / float64(n)
+}
+
+// BitsPerElementFor returns the number of bits per item an optimally
+// configured filter needs for a false positive rate of fp, -log2(fp)/ln(2);
+// for instance about 9.59 for fp = 0.01.
+func BitsPerElementFor(fp float64) float64 {
+	return -math.Log2(fp) / math.Ln2
+}
+
+// OptimalMForCurrent returns the number of bits a filter would need to hold
+// the current estimated number of items (see ApproximatedSize) at a false
+// positive rate of targetFP. Comparing it with Cap tells whether the filter
+// was over- or under-provisioned.
+func (f *BloomFilter) OptimalMForCurrent(targetFP float64) uint {
+	n := max(1, uint(f.ApproximatedSize()))
+	m, _ := EstimateParameters(n, targetFP)
+	return m
+}
+
+// minWarnBits is the size below which Warnings flags a filter as too small
+// to be useful: a single word holds fewer bits than most keysets need.
+const minWarnBits = 64
+
+// Warnings returns human-readable descriptions of likely misconfiguration,
+// or nil if none applies. It flags k larger than m, where probes mostly
+// collide; m below 64 bits; and, once items have been added, k more than a
+// factor of two away from the optimal ln(2) * m / n for the estimated number
+// of items n (see ApproximatedSize).
+func (f *BloomFilter) Warnings() []string {
+	var warnings []string
+	if f.k > f.m {
+		warnings = append(warnings, fmt.Sprintf("k (%d) exceeds m (%d): most probes hit the same bits", f.k, f.m))
+	}
+	if f.m < minWarnBits {
+		warnings = append(warnings, fmt.Sprintf("m (%d) is below %d bits: the filter saturates after a few items", f.m, minWarnBits))
+	}
+	if n := f.ApproximatedSize(); n > 0 {
+		optimal := math.Ln2 * float64(f.m) / float64(n)
+		if float64(f.k) > 2*optimal || 2*float64(f.k) < optimal {
+			warnings = append(warnings, fmt.Sprintf("k (%d) is far from the optimal %.1f for about %d items", f.k, optimal, n))
+		}
+	}
+	return warnings
+}
+
+// FilterHealth is a snapshot of a filter's fill statistics, as returned by
+// Health.
+type FilterHealth struct {
+	BitsSet       uint    // Number of set bits
+	FillRatio     float64 // BitsSet / m
+	EstimatedFP   float64 // FillRatio^k, the current false positive rate
+	EstimatedSize int64   // Estimated number of items, as ApproximatedSize
+	Saturated     bool    // Every bit is set, so every Test returns true
+}
+
+// Health returns the filter's fill statistics, computed from a single pass
+// over the bitset.
+func (f *BloomFilter) Health() FilterHealth {
+	count := f.bitset().Count()
+	fill := float64(count) / float64(f.m)
+	return FilterHealth{
+		BitsSet:       count,
+		FillRatio:     fill,
+		EstimatedFP:   math.Pow(fill, float64(f.k)),
+		EstimatedSize: f.approximatedSize(count),
+		Saturated:     count >= f.m,
+	}
+}
+
+// String returns a one-line summary of the filter: its parameters, the
+// number of set bits, the fill ratio, and the estimated false positive rate
+// and item count. It scans the bitset once.
+func (f *BloomFilter) String() string {
+	h := f.Health()
+	return fmt.Sprintf("BloomFilter{m: %d, k: %d, set: %d, fill: %.4f, fp: %.3g, n: %d}",
+		f.m, f.k, h.BitsSet, h.FillRatio, h.EstimatedFP, h.EstimatedSize)
+}
+
 // bloomFilterJSON is an unexported type for marshaling/unmarshaling BloomFilter struct.
 type bloomFilterJSON struct {
-	M uint          `json:"m"`
-	K uint          `json:"k"`
-	B *atomicBitSet `json:"b"` // Use atomicBitSet
+	M    uint          `json:"m"`
+	K    uint          `json:"k"`
+	B    *atomicBitSet `json:"b"` // Use atomicBitSet
+	Salt []byte        `json:"salt,omitempty"`
 }
 
 // MarshalJSON implements json.Marshaler interface.
 func (f BloomFilter) MarshalJSON() ([]byte, error) {
-	return json.Marshal(bloomFilterJSON{f.m, f.k, f.b})
+	return json.Marshal(bloomFilterJSON{f.m, f.k, f.bitset(), f.salt})
 }
 
 // UnmarshalJSON implements json.Unmarshaler interface.
@@ -302,14 +1458,69 @@ func (f *BloomFilter) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
+	if j.M == 0 {
+		return fmt.Errorf("invalid m value: %d", j.M)
+	}
+	if j.K == 0 {
+		return fmt.Errorf("invalid k value: %d", j.K)
+	}
+	if err := checkBitSetSize(j.M, j.B.size); err != nil {
+		return err
+	}
 	f.m = j.M
 	f.k = j.K
-	f.b = j.B
+	f.storeBitSet(j.B)
+	f.setSalt(j.Salt)
+	f.clearTrailing()
 	return nil
 }
 
 // WriteTo writes a binary representation of the BloomFilter to an i/o stream.
-func (f *BloomFilter) WriteTo(stream io.Writer) (int64, error) {
+//
+// WriteTo is safe while f is being written to. Words are loaded one at a
+// time as they are written, so the output is not a single point-in-time view
+// of f, but it is always a valid filter: every Add that completed before
+// WriteTo started is fully present, and Adds running concurrently may be
+// partially present, as for Merge. Use WriteToConsistent to shorten the
+// window over which words are read when the stream is slow.
+func (f *BloomFilter) WriteTo(stream io.Writer) (n int64, err error) {
+	if f.tracer != nil {
+		defer f.traceSpan("WriteTo", time.Now(), 0, &n, &err)
+	}
+	totalBytes, err := f.writeHeader(stream)
+	if err != nil {
+		return totalBytes, err
+	}
+
+	// Write the atomicBitSet
+	numBytes, err := f.bitset().WriteTo(stream)
+	totalBytes += numBytes
+	return totalBytes, err
+}
+
+// WriteToConsistent takes a Copy of f and writes the copy's binary
+// representation, as WriteTo, to an i/o stream. The bits written are then
+// read from f within the time of an in-memory copy rather than over the
+// whole write, which matters when the stream is slow, e.g. a network
+// connection or a large file, and writers are active. Adds running during
+// the copy may still be partially present; only stopping the writers gives
+// an exact point in time. The copy costs m/8 bytes of memory for the
+// duration of the call.
+func (f *BloomFilter) WriteToConsistent(stream io.Writer) (int64, error) {
+	return f.Copy().WriteTo(stream)
+}
+
+// saltFlag is set in the serialized k of a salted filter. The salt length
+// and the salt follow k, so filters without a salt keep the original layout.
+const saltFlag = uint64(1) << 63
+
+// maxSaltLen bounds the salt length accepted by readHeader, so that a
+// corrupt header cannot trigger a huge allocation.
+const maxSaltLen = 1 << 16
+
+// writeHeader writes m and k, the fields that precede the bitset in every
+// binary representation of the BloomFilter, followed by the salt if any.
+func (f *BloomFilter) writeHeader(stream io.Writer) (int64, error) {
 	var totalBytes int64
 
 	// Write m
@@ -320,46 +1531,385 @@ func (f *BloomFilter) WriteTo(stream io.Writer) (int64, error) {
 	totalBytes += int64(binary.Size(uint64(0)))
 
 	// Write k
-	err = binary.Write(stream, binary.BigEndian, uint64(f.k))
+	k := uint64(f.k)
+	if f.salt != nil {
+		k |= saltFlag
+	}
+	err = binary.Write(stream, binary.BigEndian, k)
 	if err != nil {
 		return totalBytes, err
 	}
 	totalBytes += int64(binary.Size(uint64(0)))
+	if f.salt == nil {
+		return totalBytes, nil
+	}
 
-	// Write the atomicBitSet
-	numBytes, err := f.b.WriteTo(stream)
-	totalBytes += numBytes
+	// Write the salt length and the salt
+	err = binary.Write(stream, binary.BigEndian, uint64(len(f.salt)))
+	if err != nil {
+		return totalBytes, err
+	}
+	totalBytes += int64(binary.Size(uint64(0)))
+	n, err := stream.Write(f.salt)
+	totalBytes += int64(n)
 	return totalBytes, err
 }
 
+// headerSize returns the number of bytes writeHeader emits.
+func (f *BloomFilter) headerSize() int64 {
+	size := 2 * int64(binary.Size(uint64(0)))
+	if f.salt != nil {
+		size += int64(binary.Size(uint64(0))) + int64(len(f.salt))
+	}
+	return size
+}
+
+// SerializedSize returns the exact number of bytes WriteTo will emit for the
+// current filter, without writing anything.
+func (f *BloomFilter) SerializedSize() int64 {
+	return f.headerSize() + f.bitset().SerializedSize()
+}
+
+// CompressionEstimate returns the size in bytes of the output of WriteTo
+// once gzipped at the default compression level, to help decide whether
+// storing the filter compressed is worthwhile. Sparse and nearly full
+// filters compress well; filters near the optimal fill ratio of one half
+// barely compress at all. The output is compressed and counted without
+// being kept, which takes about as long as writing it.
+func (f *BloomFilter) CompressionEstimate() int64 {
+	var w countingWriter
+	zw := gzip.NewWriter(&w)
+	// Writes to a countingWriter cannot fail.
+	f.WriteTo(zw)
+	zw.Close()
+	return w.n
+}
+
+// countingWriter is an io.Writer that discards what is written to it and
+// counts the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
 // ReadFrom reads a binary representation of the BloomFilter from an i/o stream.
-func (f *BloomFilter) ReadFrom(stream io.Reader) (int64, error) {
-	var totalBytes int64
-	var m, k uint64
+func (f *BloomFilter) ReadFrom(stream io.Reader) (n int64, err error) {
+	if f.tracer != nil {
+		defer f.traceSpan("ReadFrom", time.Now(), 0, &n, &err)
+	}
+	m, k, salt, totalBytes, err := readHeader(stream)
+	if err != nil {
+		return totalBytes, err
+	}
 
-	// Read m
-	err := binary.Read(stream, binary.BigEndian, &m)
+	// Read the atomicBitSet
+	b := &atomicBitSet{}
+	numBytes, err := b.ReadFrom(stream)
+	totalBytes += numBytes
 	if err != nil {
 		return totalBytes, err
 	}
-	f.m = uint(m)
+	if err := checkBitSetSize(m, b.size); err != nil {
+		return totalBytes, err
+	}
+	f.m = m
+	f.k = k
+	f.setSalt(salt)
+	f.storeBitSet(b)
+	f.clearTrailing()
+	return totalBytes, nil
+}
+
+// ReadHeader reads only the parameters, _m_ and _k_, from the start of a
+// binary representation of a BloomFilter, leaving the bitset unread. It
+// accepts the output of both WriteTo and WriteToSparse.
+func ReadHeader(r io.Reader) (m, k uint, err error) {
+	m, k, _, _, err = readHeader(r)
+	return m, k, err
+}
+
+// checkBitSetSize returns an error unless a decoded bitset of size bits can
+// back a filter of m bits. A smaller bitset would ignore the upper locations
+// and give false negatives.
+func checkBitSetSize(m, size uint) error {
+	if size != m {
+		return fmt.Errorf("invalid bitset size: %d bits for m = %d", size, m)
+	}
+	return nil
+}
+
+// readHeader reads the fields written by writeHeader and returns them along
+// with the number of bytes consumed.
+func readHeader(stream io.Reader) (m, k uint, salt []byte, totalBytes int64, err error) {
+	var m64, k64 uint64
+
+	// Read m
+	err = binary.Read(stream, binary.BigEndian, &m64)
+	if err != nil {
+		return 0, 0, nil, totalBytes, err
+	}
 	totalBytes += int64(binary.Size(uint64(0)))
 
 	// Read k
-	err = binary.Read(stream, binary.BigEndian, &k)
+	err = binary.Read(stream, binary.BigEndian, &k64)
 	if err != nil {
-		return totalBytes, err
+		return 0, 0, nil, totalBytes, err
+	}
+	totalBytes += int64(binary.Size(uint64(0)))
+	if m64 == 0 || uint64(uint(m64)) != m64 {
+		// A filter always has at least one bit; m=0 would divide by zero.
+		return 0, 0, nil, totalBytes, fmt.Errorf("invalid m value: %d", m64)
+	}
+	if k64&^saltFlag == 0 || uint64(uint(k64&^saltFlag)) != k64&^saltFlag {
+		// With no hash function, every Test would return true.
+		return 0, 0, nil, totalBytes, fmt.Errorf("invalid k value: %d", k64&^saltFlag)
+	}
+	if k64&saltFlag == 0 {
+		return uint(m64), uint(k64), nil, totalBytes, nil
+	}
+
+	// Read the salt length and the salt
+	var saltLen uint64
+	err = binary.Read(stream, binary.BigEndian, &saltLen)
+	if err != nil {
+		return 0, 0, nil, totalBytes, err
 	}
-	f.k = uint(k)
 	totalBytes += int64(binary.Size(uint64(0)))
+	if saltLen == 0 || saltLen > maxSaltLen {
+		return 0, 0, nil, totalBytes, fmt.Errorf("invalid salt length: %d", saltLen)
+	}
+	salt = make([]byte, saltLen)
+	n, err := io.ReadFull(stream, salt)
+	totalBytes += int64(n)
+	if err != nil {
+		return 0, 0, nil, totalBytes, err
+	}
+	return uint(m64), uint(k64 &^ saltFlag), salt, totalBytes, nil
+}
+
+// WriteToSparse writes a binary representation of the BloomFilter to an i/o
+// stream, omitting words with no bits set. For filters with a low fill ratio
+// this is much smaller than WriteTo; it must be read back with
+// ReadFromSparse.
+func (f *BloomFilter) WriteToSparse(stream io.Writer) (int64, error) {
+	totalBytes, err := f.writeHeader(stream)
+	if err != nil {
+		return totalBytes, err
+	}
+
+	// Write the nonzero words of the atomicBitSet
+	numBytes, err := f.bitset().WriteToSparse(stream)
+	totalBytes += numBytes
+	return totalBytes, err
+}
+
+// ReadFromSparse reads a representation written by WriteToSparse from an
+// i/o stream.
+func (f *BloomFilter) ReadFromSparse(stream io.Reader) (int64, error) {
+	m, k, salt, totalBytes, err := readHeader(stream)
+	if err != nil {
+		return totalBytes, err
+	}
 
 	// Read the atomicBitSet
-	f.b = &atomicBitSet{} // Initialize before reading into it
-	numBytes, err := f.b.ReadFrom(stream)
+	b := &atomicBitSet{}
+	numBytes, err := b.ReadFromSparse(stream)
+	totalBytes += numBytes
+	if err != nil {
+		return totalBytes, err
+	}
+	if err := checkBitSetSize(m, b.size); err != nil {
+		return totalBytes, err
+	}
+	f.m = m
+	f.k = k
+	f.setSalt(salt)
+	f.storeBitSet(b)
+	f.clearTrailing()
+	return totalBytes, nil
+}
+
+// Signature returns the indices of the n lowest set bits, in increasing
+// order, or all of them if fewer than n are set. Since items are hashed to
+// uniformly distributed bits, this is a bottom-n MinHash sketch of the set
+// bits: the fraction of indices two signatures share estimates the Jaccard
+// similarity of the filters' set bits, which makes it usable as an LSH key
+// for filters with the same _m_ and _k_.
+func (f *BloomFilter) Signature(n int) []uint64 {
+	if n <= 0 {
+		return nil
+	}
+	sig := make([]uint64, 0, n)
+	b := f.bitset()
+	for i, ok := b.NextSet(0); ok && len(sig) < n; i, ok = b.NextSet(i + 1) {
+		sig = append(sig, uint64(i))
+	}
+	return sig
+}
+
+// WriteCSV writes the BloomFilter as CSV: a first record holding m and k,
+// and the hex-encoded salt for a salted filter, followed by one record per
+// set bit holding its index, in increasing order.
+func (f *BloomFilter) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{strconv.FormatUint(uint64(f.m), 10), strconv.FormatUint(uint64(f.k), 10)}
+	if f.salt != nil {
+		header = append(header, hex.EncodeToString(f.salt))
+	}
+	err := cw.Write(header)
+	if err != nil {
+		return err
+	}
+	b := f.bitset()
+	for i, ok := b.NextSet(0); ok; i, ok = b.NextSet(i + 1) {
+		if err := cw.Write([]string{strconv.FormatUint(uint64(i), 10)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadCSV reads a BloomFilter written by WriteCSV, or written by hand in
+// the same layout, from an i/o stream.
+func (f *BloomFilter) ReadCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	if len(header) != 2 && len(header) != 3 {
+		return fmt.Errorf("invalid CSV header: want m,k[,salt], got %d fields", len(header))
+	}
+	m, err := strconv.ParseUint(header[0], 10, strconv.IntSize)
+	if err != nil {
+		return fmt.Errorf("invalid m value: %w", err)
+	}
+	if m == 0 {
+		return fmt.Errorf("invalid m value: %d", m)
+	}
+	if _, err := checkDecodedSize(m); err != nil {
+		return fmt.Errorf("invalid m value: %w", err)
+	}
+	k, err := strconv.ParseUint(header[1], 10, strconv.IntSize)
+	if err != nil {
+		return fmt.Errorf("invalid k value: %w", err)
+	}
+	if k == 0 {
+		return fmt.Errorf("invalid k value: %d", k)
+	}
+	var salt []byte
+	if len(header) == 3 {
+		salt, err = hex.DecodeString(header[2])
+		if err != nil {
+			return fmt.Errorf("invalid salt: %w", err)
+		}
+	}
+
+	b := newAtomicBitSet(uint(m))
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) != 1 {
+			return fmt.Errorf("invalid CSV record: want one bit index, got %d fields", len(record))
+		}
+		i, err := strconv.ParseUint(record[0], 10, strconv.IntSize)
+		if err != nil {
+			return fmt.Errorf("invalid bit index: %w", err)
+		}
+		if i >= m {
+			return fmt.Errorf("bit index %d out of range for m = %d", i, m)
+		}
+		// Fill the words directly: loading a filter is not a mutation, so
+		// it must not make the filter dirty.
+		b.data[i/64].Or(1 << (i % 64))
+	}
+	b.syncNonEmpty()
+	f.m = uint(m)
+	f.k = uint(k)
+	f.setSalt(salt)
+	f.storeBitSet(b)
+	return nil
+}
+
+// WriteDelta writes the bits set in f but not in since, the filter as it
+// was last saved, to an i/o stream. Because adds only ever set bits,
+// applying the delta with ApplyDelta to a copy of since reproduces f, at the
+// cost of writing only the words that changed. A nil since writes every set
+// bit. Returns an error if the parameters don't match.
+func (f *BloomFilter) WriteDelta(stream io.Writer, since *BloomFilter) (int64, error) {
+	var base *atomicBitSet
+	if since != nil {
+		if err := f.compatible(since); err != nil {
+			return 0, err
+		}
+		base = since.bitset()
+	}
+	totalBytes, err := f.writeHeader(stream)
+	if err != nil {
+		return totalBytes, err
+	}
+
+	numBytes, err := f.bitset().WriteDelta(stream, base)
 	totalBytes += numBytes
 	return totalBytes, err
 }
 
+// ApplyDelta reads a delta written by WriteDelta from an i/o stream and
+// ORs it into f. Returns an error if the delta was written by a filter with
+// different parameters; a delta that fails part way may be partially
+// applied.
+func (f *BloomFilter) ApplyDelta(stream io.Reader) (int64, error) {
+	m, k, salt, totalBytes, err := readHeader(stream)
+	if err != nil {
+		return totalBytes, err
+	}
+	if err := f.compatible(&BloomFilter{m: m, k: k, salt: salt}); err != nil {
+		return totalBytes, err
+	}
+
+	numBytes, err := f.bitset().ApplyDelta(stream)
+	totalBytes += numBytes
+	f.clearTrailing()
+	return totalBytes, err
+}
+
+// MergeFromReaders ORs into dst every filter read from readers, each a
+// binary representation written by WriteTo, without loading them as
+// BloomFilters: the header of each stream is checked against dst, then its
+// words are streamed through a small fixed buffer, so peak memory does not
+// grow with m. Returns a *ParamMismatch error, wrapped with the index of the
+// reader, if a stream was written by a filter with different parameters.
+// Readers before a failing one are fully merged, and the failing one may be
+// partially merged.
+func MergeFromReaders(dst *BloomFilter, readers ...io.Reader) error {
+	defer dst.clearTrailing()
+	b := dst.bitset()
+	for i, r := range readers {
+		m, k, salt, _, err := readHeader(r)
+		if err == nil {
+			err = dst.compatible(&BloomFilter{m: m, k: k, salt: salt})
+		}
+		if err == nil {
+			_, err = b.MergeFrom(r)
+		}
+		if err != nil {
+			return fmt.Errorf("merging reader %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
 // GobEncode implements gob.GobEncoder interface.
 func (f *BloomFilter) GobEncode() ([]byte, error) {
 	var buf bytes.Buffer
@@ -394,13 +1944,144 @@ func (f *BloomFilter) UnmarshalBinary(data []byte) error {
 	return err
 }
 
+// FromBytes parses a filter written by WriteTo (or MarshalBinary) from the
+// start of data and returns it with the number of bytes consumed, so that
+// concatenated filters can be parsed one after the other. The words are
+// decoded straight from data into the bitset, without the intermediate
+// buffer and per-word reads of UnmarshalBinary. They cannot alias data: the
+// format is big-endian and atomic words need their own aligned storage.
+func FromBytes(data []byte) (*BloomFilter, int, error) {
+	r := bytes.NewReader(data)
+	m, k, salt, n, err := readHeader(r)
+	if err != nil {
+		return nil, int(n), err
+	}
+	rest := data[n:]
+	const word = 8
+	if len(rest) < 2*word {
+		return nil, int(n), io.ErrUnexpectedEOF
+	}
+	size := binary.BigEndian.Uint64(rest)
+	dataLen := binary.BigEndian.Uint64(rest[word:])
+	rest = rest[2*word:]
+	if err := checkDecodedShape(size, dataLen); err != nil {
+		return nil, int(n), err
+	}
+	if err := checkBitSetSize(m, uint(size)); err != nil {
+		return nil, int(n), err
+	}
+	if dataLen > uint64(len(rest)/word) {
+		return nil, int(n), io.ErrUnexpectedEOF
+	}
+
+	b := newAtomicBitSet(uint(size))
+	for i := range b.data {
+		b.data[i].Store(int64(binary.BigEndian.Uint64(rest[i*word:])))
+	}
+	b.syncNonEmpty()
+	f := newFilter(m, k, b)
+	f.setSalt(salt)
+	return f, int(n) + 2*word + int(dataLen)*word, nil
+}
+
+// ToByteSlice returns the filter's bits as a flat byte slice of length
+// ceil(m/8). Bit i of the filter is stored in byte i/8 at position i%8,
+// least significant bit first. Unlike WriteTo, the output carries no header,
+// so neither the parameters nor the salt, and does not depend on the word
+// size used internally. Bits past m, which From or a decode may have left
+// in the last word, are cleared, so the output only depends on the bits in
+// use.
+func (f *BloomFilter) ToByteSlice() []byte {
+	b := f.bitset()
+	out := make([]byte, (f.m+7)/8)
+	for j := range out {
+		w := uint64(b.data[j/8].Load())
+		out[j] = byte(w >> (8 * (uint(j) % 8)))
+	}
+	if tail := f.m % 8; tail != 0 {
+		out[len(out)-1] &= 1<<tail - 1
+	}
+	return out
+}
+
+// FromByteSlice creates a new Bloom filter with _m_ bits and _k_ hashing
+// functions from the layout produced by ToByteSlice. Bits beyond _m_ are
+// ignored.
+func FromByteSlice(data []byte, m, k uint) *BloomFilter {
+	f := New(m, k)
+	b := f.bitset()
+	for j, v := range data {
+		for pos := uint(0); pos < 8; pos++ {
+			// Fill the words directly: loading a filter is not a
+			// mutation, so it must not make the filter dirty.
+			if i := uint(j)*8 + pos; v&(1<<pos) != 0 && i < b.size {
+				b.data[i/64].Or(1 << (i % 64))
+			}
+		}
+	}
+	b.syncNonEmpty()
+	return f
+}
+
 // Equal tests for the equality of two Bloom filters
 func (f *BloomFilter) Equal(g *BloomFilter) bool {
-	return f.m == g.m && f.k == g.k && f.b.Equal(g.b)
+	return f.m == g.m && f.k == g.k && bytes.Equal(f.salt, g.salt) && f.bitset().Equal(g.bitset())
+}
+
+// CanonicalBytes returns the content-addressing form of the filter: a
+// byte string that depends only on _m_, _k_, the salt and the bits in use,
+// and that is guaranteed not to change across versions of this package or
+// of Go. Filters that are Equal after their bits past m are cleared, see
+// StrictBounds, give the same bytes, so the result can be hashed to key a
+// content-addressed store. The layout is that of WriteTo for a filter whose
+// bits past m are clear, and ReadFrom and UnmarshalBinary read it back:
+//
+//   - m as a big-endian uint64
+//   - k as a big-endian uint64, with the top bit set if the filter has a salt
+//   - if it has a salt, the salt length as a big-endian uint64, then the salt
+//   - m again, then the number of words, (m+63)/64, as big-endian uint64s
+//   - the words as big-endian uint64s, bit i being bit i%64 of word i/64,
+//     with the bits past m zeroed
+//
+// A filter being written to is read as described for WriteTo.
+func (f *BloomFilter) CanonicalBytes() []byte {
+	b := f.bitset()
+	words := int((f.m + 63) / 64)
+	var buf bytes.Buffer
+	buf.Grow(int(f.headerSize()) + 16 + 8*words)
+	// Writes to a bytes.Buffer cannot fail.
+	f.writeHeader(&buf)
+	out := binary.BigEndian.AppendUint64(buf.Bytes(), uint64(f.m))
+	out = binary.BigEndian.AppendUint64(out, uint64(words))
+	for i := 0; i < words; i++ {
+		w := b.WordAt(i)
+		if tail := f.m % 64; tail != 0 && i == words-1 {
+			w &= 1<<tail - 1
+		}
+		out = binary.BigEndian.AppendUint64(out, w)
+	}
+	return out
+}
+
+// Fingerprint returns a SHA-256 digest of the filter's binary
+// representation as written by WriteTo, which covers _m_, _k_, the salt and
+// every word, so filters that are Equal have the same fingerprint and
+// filters that are not almost certainly don't. It can key a cache or a map
+// of filters; a filter being written to is read as described for WriteTo.
+func (f *BloomFilter) Fingerprint() [32]byte {
+	h := sha256.New()
+	w := bufio.NewWriter(h)
+	// Writes to a hash cannot fail.
+	f.WriteTo(w)
+	w.Flush()
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
 }
 
 // Locations returns a list of hash locations representing a data item.
-// This function remains independent of the bitset implementation.
+// This function remains independent of the bitset implementation. The
+// locations are not salted, so they only match filters without a salt.
 func Locations(data []byte, k uint) []uint64 {
 	locs := make([]uint64, k)
 	h := baseHashes(data)
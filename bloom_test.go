@@ -2,17 +2,25 @@ package bloom
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/rand"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -132,6 +140,126 @@ func TestBasicUint32(t *testing.T) {
 	}
 }
 
+func TestTestOrAddBatch(t *testing.T) {
+	f := New(10000, 4)
+	f.AddString("old")
+	items := [][]byte{[]byte("a"), []byte("old"), []byte("b"), []byte("a"), []byte("c")}
+	got := f.TestOrAddBatch(items)
+	want := []bool{false, true, false, true, false}
+	if !slices.Equal(got, want) {
+		t.Errorf("TestOrAddBatch = %v, want %v", got, want)
+	}
+	for _, item := range items {
+		if !f.Test(item) {
+			t.Errorf("%q should be in after TestOrAddBatch", item)
+		}
+	}
+	if got := f.TestOrAddBatch(items); !slices.Equal(got, []bool{true, true, true, true, true}) {
+		t.Errorf("second TestOrAddBatch = %v, want all present", got)
+	}
+	if got := f.TestOrAddBatch(nil); len(got) != 0 {
+		t.Errorf("TestOrAddBatch(nil) = %v", got)
+	}
+}
+
+func TestTestAllAny(t *testing.T) {
+	f := New(1000, 4)
+	present := [][]byte{[]byte("Bess"), []byte("Jane")}
+	absent := [][]byte{[]byte("Emma"), []byte("Lucy")}
+	for _, item := range present {
+		f.Add(item)
+	}
+	mixed := [][]byte{absent[0], present[0]}
+
+	if !f.Contains(present[0]) || f.Contains(absent[0]) {
+		t.Error("Contains should agree with Test")
+	}
+	if !f.TestAll(present) || !f.TestAny(present) {
+		t.Error("all-present items should satisfy TestAll and TestAny")
+	}
+	if f.TestAll(absent) || f.TestAny(absent) {
+		t.Error("none-present items should fail TestAll and TestAny")
+	}
+	if f.TestAll(mixed) || !f.TestAny(mixed) {
+		t.Error("mixed items should fail TestAll and satisfy TestAny")
+	}
+	if !f.TestAll(nil) || f.TestAny(nil) {
+		t.Error("empty input: TestAll should be true and TestAny false")
+	}
+}
+
+func TestTestAndAddDetailed(t *testing.T) {
+	f := New(1000, 4)
+	n1 := []byte("Bess")
+	n2 := []byte("Jane")
+
+	present, already := f.TestAndAddDetailed(n1)
+	if present || already != 0 {
+		t.Errorf("first add: got (%v, %d), want (false, 0)", present, already)
+	}
+	present, already = f.TestAndAddDetailed(n1)
+	if !present || already != 4 {
+		t.Errorf("second add: got (%v, %d), want (true, 4)", present, already)
+	}
+
+	// Craft a partial collision by setting two of n2's bits up front.
+	g := New(1000, 4)
+	locs := Locations(n2, g.K())
+	seen := make(map[uint64]bool)
+	for _, l := range locs {
+		seen[l%uint64(g.Cap())] = true
+	}
+	if len(seen) != 4 {
+		t.Fatalf("%v should map to 4 distinct bits", n2)
+	}
+	g.bitset().Set(uint(locs[0] % uint64(g.Cap())))
+	g.bitset().Set(uint(locs[2] % uint64(g.Cap())))
+	present, already = g.TestAndAddDetailed(n2)
+	if present || already != 2 {
+		t.Errorf("partial collision: got (%v, %d), want (false, 2)", present, already)
+	}
+	if !g.Test(n2) {
+		t.Errorf("%v should be in after TestAndAddDetailed", n2)
+	}
+}
+
+func TestSingleHashFastPath(t *testing.T) {
+	f := New(1000, 1)
+	g := New(1000, 1)
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		f.Add(key)
+		g.AddHash(baseHashes(key)) // generic loop
+	}
+	if !f.Equal(g) {
+		t.Error("k=1 fast path sets different bits than the generic path")
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if f.Test(key) != f.TestHash(baseHashes(key)) {
+			t.Fatalf("k=1 fast path disagrees with the generic path for %s", key)
+		}
+	}
+}
+
+func TestTestAcrossAny(t *testing.T) {
+	filters := []*BloomFilter{New(1000, 4), New(5000, 7), NewWithEstimates(100, 0.001)}
+	for i, f := range filters {
+		f.AddString(fmt.Sprintf("only%d", i))
+	}
+	for i := range filters {
+		if !TestAcrossAny(filters, []byte(fmt.Sprintf("only%d", i))) {
+			t.Errorf("only%d should be found across the filters", i)
+		}
+	}
+	if TestAcrossAny(filters, []byte("nowhere")) {
+		t.Error("nowhere should not be found across the filters")
+	}
+	if TestAcrossAny(nil, []byte("only0")) {
+		t.Error("nothing should be found across no filters")
+	}
+}
+
 func TestNewWithLowNumbers(t *testing.T) {
 	f := New(0, 0)
 	if f.k != 1 {
@@ -142,6 +270,62 @@ func TestNewWithLowNumbers(t *testing.T) {
 	}
 }
 
+func TestNewWordAligned(t *testing.T) {
+	for _, tt := range []struct{ m, want uint }{{0, 64}, {1, 64}, {64, 64}, {65, 128}, {100, 128}, {1000, 1024}} {
+		f := NewWordAligned(tt.m, 4)
+		if f.Cap() != tt.want {
+			t.Errorf("NewWordAligned(%d) has m=%d, want %d", tt.m, f.Cap(), tt.want)
+		}
+		if allocated := uint(len(f.bitset().data)) * 64; allocated != f.Cap() {
+			t.Errorf("NewWordAligned(%d) addresses %d bits of %d allocated", tt.m, f.Cap(), allocated)
+		}
+	}
+
+	// Probes reach the bits that New(100, k) leaves unused.
+	f := NewWordAligned(100, 4)
+	for i := 0; i < 100; i++ {
+		f.AddString(fmt.Sprint(i))
+	}
+	if f.bitset().CountRange(100, 128) == 0 {
+		t.Error("no probe landed in bits 100 to 127")
+	}
+	var g BloomFilter
+	data, _ := f.MarshalBinary()
+	if err := g.UnmarshalBinary(data); err != nil || g.Cap() != 128 || !g.Equal(f) {
+		t.Errorf("the rounded m should be persisted: %v", err)
+	}
+}
+
+func TestNewStrict(t *testing.T) {
+	for _, mk := range [][2]uint{{0, 3}, {100, 0}, {0, 0}} {
+		if f, err := NewStrict(mk[0], mk[1]); err == nil || f != nil {
+			t.Errorf("NewStrict(%d, %d) should fail", mk[0], mk[1])
+		}
+	}
+	f, err := NewStrict(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Cap() != 1 || f.K() != 1 {
+		t.Errorf("NewStrict(1, 1) has m=%d, k=%d", f.Cap(), f.K())
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	f := NewWithOptions(Options{})
+	if f.Cap() != 1 || f.K() != 1 {
+		t.Errorf("zero options should match New(0, 0), got m=%d, k=%d", f.Cap(), f.K())
+	}
+	f = NewWithOptions(Options{M: 1000})
+	if f.Cap() != 1000 || f.K() != 1 {
+		t.Errorf("M option not applied, got m=%d, k=%d", f.Cap(), f.K())
+	}
+	f = NewWithOptions(Options{M: 1000, K: 4})
+	if !f.Equal(New(1000, 4)) {
+		t.Errorf("K option not applied, got m=%d, k=%d", f.Cap(), f.K())
+	}
+}
+
 func TestString(t *testing.T) {
 	f := NewWithEstimates(1000, 0.001)
 	n1 := "Love"
@@ -178,6 +362,239 @@ func TestString(t *testing.T) {
 
 }
 
+func TestNewFromStrings(t *testing.T) {
+	items := make([]string, 1000)
+	for i := range items {
+		items[i] = fmt.Sprintf("item%d", i)
+	}
+	f := NewFromStrings(items, 0.01)
+	for _, item := range items {
+		if !f.TestString(item) {
+			t.Fatalf("%v should be in.", item)
+		}
+	}
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if f.TestString(fmt.Sprintf("other%d", i)) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / 10000; rate > 0.015 {
+		t.Errorf("False positive rate too high: %v", rate)
+	}
+}
+
+func TestNewFromStringsEmpty(t *testing.T) {
+	for name, items := range map[string][]string{"nil": nil, "empty": {}} {
+		f := NewFromStrings(items, 0.01)
+		if f.K() > 64 {
+			t.Fatalf("%s: k=%d is too large", name, f.K())
+		}
+		f.AddString("x")
+		if !f.TestString("x") {
+			t.Errorf("%s: x should be in", name)
+		}
+	}
+}
+
+func TestPlanFilter(t *testing.T) {
+	for _, c := range []struct {
+		n  uint
+		fp float64
+	}{{1000, 0.01}, {10000, 0.001}, {100000, 0.0001}, {1, 0.5}} {
+		m, k, size, actual := PlanFilter(c.n, c.fp)
+		if m%64 != 0 || size != m/8 {
+			t.Errorf("n=%d fp=%v: m=%d is not word aligned or size=%d is wrong", c.n, c.fp, m, size)
+		}
+		if actual > c.fp || (c.n > 1 && actual < c.fp/2) {
+			t.Errorf("n=%d fp=%v: planned fp %v is off target", c.n, c.fp, actual)
+		}
+		if measured := EstimateFalsePositiveRate(m, k, c.n); c.n > 1 && measured > 1.5*c.fp {
+			t.Errorf("n=%d fp=%v: measured fp %v with m=%d, k=%d", c.n, c.fp, measured, m, k)
+		}
+	}
+	for _, fp := range []float64{0, -0.1, 1, 1.5, math.Inf(1), math.NaN()} {
+		if m, k, size, actual := PlanFilter(100000000, fp); m != 0 || k != 0 || size != 0 || actual != 0 {
+			t.Errorf("fp=%v cannot be planned, got m=%d, k=%d, size=%d, actualFP=%v", fp, m, k, size, actual)
+		}
+	}
+	if m, k, size, _ := PlanFilter(100, 1.5); m != 0 || k != 0 || size != 0 {
+		t.Errorf("fp=1.5 cannot be planned, got m=%d, k=%d, size=%d", m, k, size)
+	}
+}
+
+func TestPlanFilterLargeN(t *testing.T) {
+	// Large enough that growing m a word at a time would never finish.
+	n := ^uint(0) / 1000
+	for _, fp := range []float64{0.01, 1e-6} {
+		m, k, _, actual := PlanFilter(n, fp)
+		if m == 0 || m%64 != 0 || actual > fp {
+			t.Fatalf("fp=%v: got m=%d, actualFP=%v", fp, m, actual)
+		}
+		if analyticFP(m-64, BestKForM(m-64, n), n) <= fp {
+			t.Errorf("fp=%v: m=%d is not the smallest word count meeting the target", fp, m)
+		}
+		if BestKForM(m, n) != k {
+			t.Errorf("fp=%v: k=%d, want %d", fp, k, BestKForM(m, n))
+		}
+	}
+}
+
+func TestAddStream(t *testing.T) {
+	blob := make([]byte, 100000) // Many chunks of the streaming buffer
+	rand.New(rand.NewSource(1)).Read(blob)
+
+	f := New(10000, 5)
+	if err := f.AddStream(iotest.HalfReader(bytes.NewReader(blob))); err != nil {
+		t.Fatal(err)
+	}
+	g := New(10000, 5).Add(blob)
+	if !f.Equal(g) {
+		t.Error("AddStream should set the same bits as Add")
+	}
+	if ok, err := g.TestStream(bytes.NewReader(blob)); err != nil || !ok {
+		t.Errorf("TestStream = %v, %v for an added blob", ok, err)
+	}
+	if ok, err := g.TestStream(bytes.NewReader(blob[1:])); err != nil || ok {
+		t.Errorf("TestStream = %v, %v for a blob not added", ok, err)
+	}
+
+	salted := NewWithSalt(10000, 5, []byte("s"))
+	if err := salted.AddStream(bytes.NewReader(blob)); err != nil || !salted.Test(blob) {
+		t.Error("AddStream should apply the salt")
+	}
+
+	errRead := errors.New("read failed")
+	h := New(10000, 5)
+	if err := h.AddStream(io.MultiReader(bytes.NewReader(blob), iotest.ErrReader(errRead))); err != errRead {
+		t.Errorf("AddStream error = %v, want %v", err, errRead)
+	}
+	if !h.IsEmpty() {
+		t.Error("a failed AddStream should add nothing")
+	}
+	if _, err := g.TestStream(iotest.ErrReader(errRead)); err != errRead {
+		t.Errorf("TestStream error = %v, want %v", err, errRead)
+	}
+}
+
+func TestMinBitsForFP(t *testing.T) {
+	if m := MinBitsForFP(1000, 0.01); m != 9586 {
+		t.Errorf("MinBitsForFP(1000, 0.01) = %d, want 9586", m)
+	}
+	for _, n := range []uint{1, 10, 1000, 123457, 10000000} {
+		for _, fp := range []float64{0.5, 0.1, 0.01, 0.001, 1e-9} {
+			want, _ := EstimateParameters(n, fp)
+			if m := MinBitsForFP(n, fp); m != want {
+				t.Errorf("MinBitsForFP(%d, %g) = %d, want %d as from EstimateParameters", n, fp, m, want)
+			}
+		}
+	}
+}
+
+func TestEstimateParametersChecked(t *testing.T) {
+	const limit = 1 << 31 // bits in 256 MiB
+	m, k, err := EstimateParametersChecked(1000, 0.01, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantM, wantK := EstimateParameters(1000, 0.01); m != wantM || k != wantK {
+		t.Errorf("got m=%d, k=%d, want m=%d, k=%d", m, k, wantM, wantK)
+	}
+	if m, k, err := EstimateParametersChecked(0, 0.01, limit); err != nil || m == 0 || k == 0 {
+		t.Errorf("n=0: got m=%d, k=%d, err=%v", m, k, err)
+	}
+
+	for _, c := range []struct {
+		n    uint
+		p    float64
+		maxM uint
+	}{
+		{1e9, 1e-12, limit},
+		{1e6, 1e-300, 1 << 30},
+		{1 << 30, math.SmallestNonzeroFloat64, limit},
+		{^uint(0), 1e-12, ^uint(0)},
+		{1000, 0, limit},
+		{1000, 1, limit},
+		{1000, -0.5, limit},
+		{1000, math.NaN(), limit},
+		{1000, math.Inf(1), limit},
+	} {
+		if m, k, err := EstimateParametersChecked(c.n, c.p, c.maxM); err == nil {
+			t.Errorf("n=%d p=%v maxM=%d: expected an error, got m=%d, k=%d", c.n, c.p, c.maxM, m, k)
+		}
+	}
+}
+
+func TestBestKForM(t *testing.T) {
+	for _, c := range []struct{ m, n uint }{
+		{1000, 100}, {1 << 20, 100000}, {64, 1000}, {10000, 7}, {9585, 1000},
+	} {
+		k := BestKForM(c.m, c.n)
+		best := analyticFP(c.m, k, c.n)
+		for dk := uint(1); dk <= 3; dk++ {
+			if fp := analyticFP(c.m, k+dk, c.n); fp < best {
+				t.Errorf("m=%d n=%d: k=%d gives fp %v, but k=%d gives %v", c.m, c.n, k, best, k+dk, fp)
+			}
+			if k > dk {
+				if fp := analyticFP(c.m, k-dk, c.n); fp < best {
+					t.Errorf("m=%d n=%d: k=%d gives fp %v, but k=%d gives %v", c.m, c.n, k, best, k-dk, fp)
+				}
+			}
+		}
+		if f := NewFixedM(c.m, c.n); f.Cap() != c.m || f.K() != k {
+			t.Errorf("NewFixedM(%d, %d) has m=%d, k=%d, want k=%d", c.m, c.n, f.Cap(), f.K(), k)
+		}
+	}
+	if k := BestKForM(0, 10); k != 1 {
+		t.Errorf("BestKForM(0, 10) = %d, want 1", k)
+	}
+}
+
+func TestMeasureFalsePositiveRate(t *testing.T) {
+	f := New(10000, 4)
+	for i := 0; i < 1500; i++ {
+		f.AddString(fmt.Sprintf("user:%d", i))
+	}
+	absent := make([][]byte, 20000)
+	for i := range absent {
+		absent[i] = []byte(fmt.Sprintf("user:%d", 1500+i))
+	}
+	measured := f.MeasureFalsePositiveRate(absent)
+	expected := math.Pow(float64(f.Count())/float64(f.Cap()), float64(f.K()))
+	if measured == 0 || measured > 1.5*expected || measured < expected/1.5 {
+		t.Errorf("measured fp %v, expected about %v", measured, expected)
+	}
+	if rate := f.MeasureFalsePositiveRate(nil); rate != 0 {
+		t.Errorf("empty sample: rate %v, want 0", rate)
+	}
+	if rate := New(10000, 4).MeasureFalsePositiveRate(absent); rate != 0 {
+		t.Errorf("empty filter: rate %v, want 0", rate)
+	}
+}
+
+func TestEstimateFalsePositiveRateDegenerate(t *testing.T) {
+	for _, c := range []struct {
+		m, k, n uint
+		want    float64 // -1 for any rate in range
+	}{
+		{0, 0, 0, 0},
+		{0, 5, 10, 1},
+		{1000, 0, 10, -1},
+		{64, 3, 1 << 20, 1},
+		{1000, 4, math.MaxUint32, 1},
+		{1000, 4, ^uint(0), 1},
+		{1 << 16, 200, 100, -1},
+	} {
+		rate := EstimateFalsePositiveRate(c.m, c.k, c.n)
+		if math.IsNaN(rate) || rate < 0 || rate > 1 {
+			t.Errorf("m=%d k=%d n=%d: rate %v is out of range", c.m, c.k, c.n, rate)
+		}
+		if c.want >= 0 && rate != c.want {
+			t.Errorf("m=%d k=%d n=%d: rate %v, want %v", c.m, c.k, c.n, rate, c.want)
+		}
+	}
+}
+
 func testEstimated(n uint, maxFp float64, t *testing.T) {
 	m, k := EstimateParameters(n, maxFp)
 	fpRate := EstimateFalsePositiveRate(m, k, n)
@@ -278,6 +695,219 @@ func TestLocation(t *testing.T) {
 
 }
 
+// For tiny m every probe must still be uniform over [0, m), even though
+// probes repeat with period max(4, m) when m is a power of two.
+func TestLocationSmallM(t *testing.T) {
+	rounds := uint(20000)
+	elements := make([][]byte, rounds)
+	for x := uint(0); x < rounds; x++ {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, uint32(x))
+		elements[x] = data
+	}
+	for m := uint(2); m <= 8; m++ {
+		for k := uint(1); k <= 8; k++ {
+			if !chiTestBloom(m, k, rounds, elements) {
+				t.Errorf("m=%d, k=%d: random assignment is too unrandom", m, k)
+			}
+		}
+	}
+
+	for _, m := range []uint{2, 4, 8, 16} {
+		period := max(4, m)
+		f := New(m, 2*period)
+		for _, data := range elements[:100] {
+			h := baseHashes(data)
+			for i := uint(0); i < period; i++ {
+				if f.location(h, i) != f.location(h, i+period) {
+					t.Fatalf("m=%d: probe %d and %d differ", m, i, i+period)
+				}
+			}
+		}
+	}
+}
+
+func TestDouble(t *testing.T) {
+	items := make([][]byte, 1000)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("item%d", i))
+	}
+	f := NewWithSalt(8000, 6, []byte("s")).AddBatch(items)
+	g := f.Double(items)
+	if g.Cap() != 16000 || g.K() != BestKForM(16000, 1000) || !bytes.Equal(g.Salt(), f.Salt()) {
+		t.Errorf("doubled filter has m=%d, k=%d, salt %q", g.Cap(), g.K(), g.Salt())
+	}
+	if f.Cap() != 8000 || f.K() != 6 {
+		t.Error("Double should not modify f")
+	}
+	for _, item := range items {
+		if !g.Test(item) {
+			t.Fatalf("%s is missing from the doubled filter", item)
+		}
+	}
+	absent := make([][]byte, 20000)
+	for i := range absent {
+		absent[i] = []byte(fmt.Sprintf("absent%d", i))
+	}
+	before, after := f.MeasureFalsePositiveRate(absent), g.MeasureFalsePositiveRate(absent)
+	if after >= before/2 {
+		t.Errorf("fp rate went from %v to %v, expected a large drop", before, after)
+	}
+}
+
+func TestTotalAdds(t *testing.T) {
+	f := New(1000, 4)
+	if f.TotalAdds() != 0 {
+		t.Fatal("a new filter should have no adds")
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 250; i++ {
+				f.AddString(fmt.Sprint(i % 10)) // mostly duplicates
+			}
+		}()
+	}
+	wg.Wait()
+	if got := f.TotalAdds(); got != 1000 {
+		t.Errorf("TotalAdds = %d after 1000 adds", got)
+	}
+	if n := f.AddN([]byte("x")); n != 1001 {
+		t.Errorf("AddN returned %d, want 1001", n)
+	}
+	f.AddHash(baseHashes([]byte("x")))
+	f.AddLocations(Locations([]byte("x"), 4))
+	f.AddCounting([]byte("x"))
+	f.TestAndAdd([]byte("x"))
+	f.TestAndAddDetailed([]byte("x"))
+	f.TestOrAdd([]byte("x"))
+	f.Test([]byte("x"))
+	if got := f.TotalAdds(); got != 1007 {
+		t.Errorf("TotalAdds = %d, want 1007", got)
+	}
+	f.Refresh([][]byte{[]byte("a"), []byte("b")})
+	if got := f.TotalAdds(); got != 2 {
+		t.Errorf("TotalAdds = %d after Refresh with 2 items, want 2", got)
+	}
+}
+
+func TestDirty(t *testing.T) {
+	other := New(1000, 4)
+	other.AddString("other")
+	mutations := map[string]func(f *BloomFilter){
+		"Add":         func(f *BloomFilter) { f.AddString("x") },
+		"AddHash":     func(f *BloomFilter) { f.AddHash(baseHashes([]byte("x"))) },
+		"AddCounting": func(f *BloomFilter) { f.AddCounting([]byte("x")) },
+		"TestAndAdd":  func(f *BloomFilter) { f.TestAndAdd([]byte("x")) },
+		"TestOrAdd":   func(f *BloomFilter) { f.TestOrAdd([]byte("x")) },
+		"Merge":       func(f *BloomFilter) { f.Merge(other) },
+		"UnionInto":   func(f *BloomFilter) { UnionInto(other, other, f) },
+		"ClearAll":    func(f *BloomFilter) { f.ClearAll() },
+		"SwapBitSet":  func(f *BloomFilter) { f.SwapBitSet(New(1000, 4).BitSet()) },
+		"BitSet.Set":  func(f *BloomFilter) { f.BitSet().Set(3) },
+	}
+	for name, mutate := range mutations {
+		f := New(1000, 4)
+		if f.IsDirty() {
+			t.Fatal("a new filter should be clean")
+		}
+		mutate(f)
+		if !f.IsDirty() {
+			t.Errorf("%s should make the filter dirty", name)
+		}
+		f.MarkClean()
+		if f.IsDirty() {
+			t.Errorf("MarkClean after %s should make the filter clean", name)
+		}
+	}
+
+	f := New(1000, 4)
+	f.AddString("x")
+	f.MarkClean()
+	f.Test([]byte("x"))
+	f.Copy()
+	if f.IsDirty() {
+		t.Error("read-only operations should not make the filter dirty")
+	}
+	if f.IsEmpty() {
+		t.Error("MarkClean should not affect IsEmpty")
+	}
+	var g BloomFilter
+	data, _ := f.MarshalBinary()
+	if err := g.UnmarshalBinary(data); err != nil || g.IsDirty() {
+		t.Errorf("a freshly loaded filter should be clean: %v", err)
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	f := New(1000, 4)
+	if !f.IsEmpty() {
+		t.Error("new filter should be empty")
+	}
+	f.AddString("one")
+	if f.IsEmpty() {
+		t.Error("filter should not be empty after an add")
+	}
+	if f.Copy().IsEmpty() {
+		t.Error("copy of a non-empty filter should not be empty")
+	}
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ClearAll()
+	if !f.IsEmpty() {
+		t.Error("filter should be empty after ClearAll")
+	}
+
+	var g BloomFilter
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if g.IsEmpty() {
+		t.Error("decoded non-empty filter should not be empty")
+	}
+	if err := f.Merge(&g); err != nil || f.IsEmpty() {
+		t.Errorf("filter should not be empty after merging a non-empty one: %v", err)
+	}
+}
+
+func TestNewPow2(t *testing.T) {
+	for _, c := range [][2]uint{{0, 1}, {1, 1}, {2, 2}, {3, 4}, {1000, 1024}, {1024, 1024}, {1025, 2048}} {
+		if m := NewPow2(c[0], 4).Cap(); m != c[1] {
+			t.Errorf("NewPow2(%d, 4).Cap() = %d, want %d", c[0], m, c[1])
+		}
+	}
+
+	f := NewPow2(1000, 4)
+	for i := 0; i < 100; i++ {
+		f.AddString(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 100; i++ {
+		h := baseHashes([]byte(fmt.Sprintf("key%d", i)))
+		for j := uint(0); j < f.K(); j++ {
+			if f.location(h, j) != uint(location(h, j)%uint64(f.Cap())) {
+				t.Fatal("masked location differs from the modulo location")
+			}
+		}
+	}
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g BloomFilter
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if !g.TestString(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("key%d missing after reload", i)
+		}
+	}
+}
+
 func TestCap(t *testing.T) {
 	f := New(1000, 4)
 	if f.Cap() != f.m {
@@ -311,16 +941,16 @@ func TestMarshalUnmarshalJSON(t *testing.T) {
 	if g.k != f.k {
 		t.Error("invalid k value")
 	}
-	if g.b == nil {
+	if g.bitset() == nil {
 		t.Fatal("bitset is nil")
 	}
-	if !g.b.Equal(f.b) {
+	if !g.bitset().Equal(f.bitset()) {
 		t.Error("bitsets are not equal")
 	}
 }
 
 func TestMarshalUnmarshalJSONValue(t *testing.T) {
-	f := BloomFilter{1000, 4, newAtomicBitSet(1000)}
+	f := BloomFilter{m: 1000, k: 4, b: newAtomicBitSet(1000)}
 	data, err := json.Marshal(f)
 	if err != nil {
 		t.Fatal(err.Error())
@@ -375,49 +1005,297 @@ func TestWriteToReadFrom(t *testing.T) {
 	if g.k != f.k {
 		t.Error("invalid k value")
 	}
-	if g.b == nil {
+	if g.bitset() == nil {
 		t.Fatal("bitset is nil")
 	}
-	if !g.b.Equal(f.b) {
+	if !g.bitset().Equal(f.bitset()) {
 		t.Error("bitsets are not equal")
 	}
 
 	g.Test([]byte(""))
 }
 
-func TestReadWriteBinary(t *testing.T) {
+func TestReadHeader(t *testing.T) {
 	f := New(1000, 4)
+	f.AddString("one")
 	var buf bytes.Buffer
-	bytesWritten, err := f.WriteTo(&buf)
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	m, k, err := ReadHeader(&buf)
 	if err != nil {
-		t.Fatal(err.Error())
+		t.Fatal(err)
 	}
-	if bytesWritten != int64(buf.Len()) {
-		t.Errorf("incorrect write length %d != %d", bytesWritten, buf.Len())
+	if m != f.Cap() || k != f.K() {
+		t.Errorf("ReadHeader() = (%d, %d), want (%d, %d)", m, k, f.Cap(), f.K())
+	}
+	if int64(buf.Len()) != f.bitset().SerializedSize() {
+		t.Errorf("ReadHeader consumed past the header, %d bytes left", buf.Len())
 	}
+	if _, _, err := ReadHeader(bytes.NewReader([]byte{0, 0, 0})); err == nil {
+		t.Error("expected an error reading a truncated header")
+	}
+}
 
-	var g BloomFilter
-	bytesRead, err := g.ReadFrom(&buf)
-	if err != nil {
-		t.Fatal(err.Error())
+func TestWriteToReadFromSparse(t *testing.T) {
+	f := New(100000, 4)
+	for i := 0; f.bitset().Count() < f.Cap()/100; i++ {
+		f.AddString(fmt.Sprintf("key%d", i))
 	}
-	if bytesRead != bytesWritten {
-		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+
+	var dense, sparse bytes.Buffer
+	if _, err := f.WriteTo(&dense); err != nil {
+		t.Fatal(err)
 	}
-	if g.m != f.m {
-		t.Error("invalid m value")
+	written, err := f.WriteToSparse(&sparse)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if g.k != f.k {
-		t.Error("invalid k value")
+	if written != int64(sparse.Len()) {
+		t.Errorf("incorrect write length %d != %d", written, sparse.Len())
 	}
-	if g.b == nil {
-		t.Fatal("bitset is nil")
+	if sparse.Len() >= dense.Len()*3/4 {
+		t.Errorf("sparse encoding of a 1%% full filter is %d bytes, dense is %d", sparse.Len(), dense.Len())
 	}
-	if !g.b.Equal(f.b) {
+
+	var g BloomFilter
+	read, err := g.ReadFromSparse(&sparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != written {
+		t.Errorf("read unexpected number of bytes %d != %d", read, written)
+	}
+	if !f.Equal(&g) {
+		t.Error("filters are not equal after a sparse round trip")
+	}
+
+	var empty bytes.Buffer
+	if _, err := New(1000, 4).WriteToSparse(&empty); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.ReadFromSparse(&empty); err != nil || !g.Equal(New(1000, 4)) {
+		t.Errorf("empty filter does not survive a sparse round trip: %v", err)
+	}
+}
+
+func TestWriteDeltaApplyDelta(t *testing.T) {
+	f := New(100000, 4)
+	for i := 0; i < 5000; i++ {
+		f.AddString(fmt.Sprintf("key%d", i))
+	}
+	var saved bytes.Buffer
+	if _, err := f.WriteTo(&saved); err != nil {
+		t.Fatal(err)
+	}
+	baseline := f.Copy()
+
+	for i := 5000; i < 5100; i++ {
+		f.AddString(fmt.Sprintf("key%d", i))
+	}
+	var delta bytes.Buffer
+	written, err := f.WriteDelta(&delta, baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(delta.Len()) {
+		t.Errorf("incorrect write length %d != %d", written, delta.Len())
+	}
+	if delta.Len() >= saved.Len()/4 {
+		t.Errorf("delta for 2%% more items is %d bytes, full save is %d", delta.Len(), saved.Len())
+	}
+
+	var g BloomFilter
+	if _, err := g.ReadFrom(&saved); err != nil {
+		t.Fatal(err)
+	}
+	read, err := g.ApplyDelta(&delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != written {
+		t.Errorf("read unexpected number of bytes %d != %d", read, written)
+	}
+	var full, patched bytes.Buffer
+	if _, err := f.WriteTo(&full); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.WriteTo(&patched); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(full.Bytes(), patched.Bytes()) {
+		t.Error("applying the delta does not reproduce a fresh full save")
+	}
+
+	delta.Reset()
+	if _, err := f.WriteDelta(&delta, nil); err != nil {
+		t.Fatal(err)
+	}
+	h := New(100000, 4)
+	if _, err := h.ApplyDelta(&delta); err != nil || !h.Equal(f) {
+		t.Errorf("a delta against nil should hold every set bit: %v", err)
+	}
+
+	if _, err := f.WriteDelta(&delta, New(1000, 4)); err == nil {
+		t.Error("expected an error writing a delta against a different filter")
+	}
+	delta.Reset()
+	if _, err := f.WriteDelta(&delta, baseline); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(100000, 5).ApplyDelta(&delta); err == nil {
+		t.Error("expected an error applying a delta to a different filter")
+	}
+}
+
+func TestFromBytes(t *testing.T) {
+	f := NewWithEstimates(1000000, 0.001)
+	for i := 0; i < 100000; i++ {
+		f.AddString(fmt.Sprint(i))
+	}
+	g := NewWithSalt(1000, 4, []byte("second"))
+	g.AddString("x")
+	blob, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := g.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob = append(blob, second...)
+
+	var want BloomFilter
+	if err := want.UnmarshalBinary(blob); err != nil {
+		t.Fatal(err)
+	}
+	got, n, err := FromBytes(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(blob)-len(second) {
+		t.Errorf("consumed %d bytes, want %d", n, len(blob)-len(second))
+	}
+	if !got.Equal(&want) || !got.Equal(f) {
+		t.Error("FromBytes differs from UnmarshalBinary")
+	}
+	got, m, err := FromBytes(blob[n:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != len(second) || !got.Equal(g) {
+		t.Error("FromBytes should parse the concatenated second filter")
+	}
+
+	for _, cut := range []int{0, 10, 16, 24, 40, len(second) - 1} {
+		if _, _, err := FromBytes(second[:cut]); err == nil {
+			t.Errorf("expected an error parsing %d of %d bytes", cut, len(second))
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		// m, k, size, data length, then the words
+		"size below m": encodeUint64s(1000, 3, 64, 1, 0),
+		"size above m": encodeUint64s(100, 3, 128, 2, 0, 0),
+		"huge length":  encodeUint64s(100, 3, 1<<63, 1<<57),
+	} {
+		if _, _, err := FromBytes(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func BenchmarkFromBytes(b *testing.B) {
+	f := New(1<<24, 4)
+	blob, _ := f.MarshalBinary()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FromBytes(blob)
+	}
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	f := New(1<<24, 4)
+	blob, _ := f.MarshalBinary()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var g BloomFilter
+		g.UnmarshalBinary(blob)
+	}
+}
+
+func TestReadWriteBinary(t *testing.T) {
+	f := New(1000, 4)
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytesWritten != int64(buf.Len()) {
+		t.Errorf("incorrect write length %d != %d", bytesWritten, buf.Len())
+	}
+
+	var g BloomFilter
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	if g.m != f.m {
+		t.Error("invalid m value")
+	}
+	if g.k != f.k {
+		t.Error("invalid k value")
+	}
+	if g.bitset() == nil {
+		t.Fatal("bitset is nil")
+	}
+	if !g.bitset().Equal(f.bitset()) {
 		t.Error("bitsets are not equal")
 	}
 }
 
+func TestSerializedSize(t *testing.T) {
+	for _, m := range []uint{1, 63, 64, 65, 1000} {
+		f := New(m, 4)
+		f.Add([]byte("one"))
+		var w countingWriter
+		written, err := f.WriteTo(&w)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if f.SerializedSize() != written || written != w.n {
+			t.Errorf("m=%d: SerializedSize() = %d, WriteTo wrote %d (returned %d)", m, f.SerializedSize(), w.n, written)
+		}
+	}
+}
+
+func TestCompressionEstimate(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 20000} {
+		f := New(100000, 5)
+		for i := 0; i < n; i++ {
+			f.AddString(fmt.Sprint(i))
+		}
+		serialized, err := f.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(serialized); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.CompressionEstimate(); got != int64(buf.Len()) {
+			t.Errorf("n=%d: CompressionEstimate() = %d, gzip of MarshalBinary is %d bytes", n, got, buf.Len())
+		}
+	}
+}
+
 func TestEncodeDecodeGob(t *testing.T) {
 	f := New(1000, 4)
 	f.Add([]byte("one"))
@@ -440,10 +1318,10 @@ func TestEncodeDecodeGob(t *testing.T) {
 	if g.k != f.k {
 		t.Error("invalid k value")
 	}
-	if g.b == nil {
+	if g.bitset() == nil {
 		t.Fatal("bitset is nil")
 	}
-	if !g.b.Equal(f.b) {
+	if !g.bitset().Equal(f.bitset()) {
 		t.Error("bitsets are not equal")
 	}
 	if !g.Test([]byte("three")) {
@@ -457,6 +1335,176 @@ func TestEncodeDecodeGob(t *testing.T) {
 	}
 }
 
+func TestDecodeZeroM(t *testing.T) {
+	f := New(1000, 4)
+	f.AddString("one")
+	data, err := f.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint64(data, 0) // m
+
+	var g BloomFilter
+	if err := g.GobDecode(data); err == nil {
+		t.Error("expected an error decoding a gob with m=0")
+	}
+	if err := g.UnmarshalBinary(data); err == nil {
+		t.Error("expected an error decoding binary data with m=0")
+	}
+	if _, err := g.ReadFromSparse(bytes.NewReader(data)); err == nil {
+		t.Error("expected an error decoding sparse data with m=0")
+	}
+	if _, _, err := ReadHeader(bytes.NewReader(data)); err == nil {
+		t.Error("expected an error reading a header with m=0")
+	}
+	err = json.Unmarshal([]byte(`{"m":0,"k":4,"b":{"size":64,"data":[0]}}`), &g)
+	if err == nil {
+		t.Error("expected an error decoding JSON with m=0")
+	}
+}
+
+// encodeUint64s encodes values as big-endian uint64s, for building corrupt
+// serialized filters.
+func encodeUint64s(values ...uint64) []byte {
+	var data []byte
+	for _, v := range values {
+		data = binary.BigEndian.AppendUint64(data, v)
+	}
+	return data
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	for name, data := range map[string][]byte{
+		// m, k, size, data length, then the words
+		"too few words":  encodeUint64s(100, 3, 128, 1, 0),
+		"too many words": encodeUint64s(100, 3, 100, 3, 0, 0, 0),
+		"huge length":    encodeUint64s(100, 3, 100, 1<<62),
+		"huge size":      encodeUint64s(1<<63, 3, 1<<63, 1<<57),
+		"size above m":   encodeUint64s(100, 3, 128, 2, 0, 0),
+		"size below m":   encodeUint64s(1000, 3, 64, 1, 0),
+		"zero k":         encodeUint64s(100, 0, 100, 2, 0, 0),
+		"zero salted k":  append(encodeUint64s(100, saltFlag, 1), append([]byte("s"), encodeUint64s(100, 2, 0, 0)...)...),
+		"truncated":      encodeUint64s(100, 3, 100, 2, 0),
+	} {
+		var f BloomFilter
+		if err := f.UnmarshalBinary(data); err == nil {
+			t.Errorf("%s: expected an error from UnmarshalBinary", name)
+		}
+		if err := f.GobDecode(data); err == nil {
+			t.Errorf("%s: expected an error from GobDecode", name)
+		}
+	}
+
+	// A failed decode leaves the filter as it was.
+	f := New(1000, 4).AddString("kept")
+	if err := f.UnmarshalBinary(encodeUint64s(100, 3, 128, 2, 0, 0)); err == nil {
+		t.Fatal("expected an error")
+	}
+	if f.Cap() != 1000 || !f.TestString("kept") {
+		t.Error("a failed decode should not modify the filter")
+	}
+	f.AddString("after") // Must not panic
+
+	for name, data := range map[string]string{
+		"zero k":       `{"m":100,"k":0,"b":{"size":100,"data":[0,0]}}`,
+		"size above m": `{"m":100,"k":3,"b":{"size":128,"data":[0,0]}}`,
+		"size below m": `{"m":1000,"k":3,"b":{"size":64,"data":[0]}}`,
+	} {
+		var g BloomFilter
+		if err := json.Unmarshal([]byte(data), &g); err == nil {
+			t.Errorf("%s: expected an error from UnmarshalJSON", name)
+		}
+	}
+}
+
+func TestReadFromSparseCorrupt(t *testing.T) {
+	for name, data := range map[string][]byte{
+		// m, k, size, data length, number of nonzero words
+		"too few words":    encodeUint64s(128, 3, 128, 1, 0),
+		"too many words":   encodeUint64s(128, 3, 128, 3, 0),
+		"huge length":      encodeUint64s(128, 3, 128, 1<<62, 0),
+		"huge size":        encodeUint64s(1<<63, 3, 1<<63, 1<<57, 0),
+		"size below m":     encodeUint64s(1000, 3, 64, 1, 0),
+		"size above m":     encodeUint64s(64, 3, 128, 2, 0),
+		"word past end":    append(encodeUint64s(128, 3, 128, 2, 1), append([]byte{2}, encodeUint64s(1)...)...),
+		"too many nonzero": encodeUint64s(128, 3, 128, 2, 3),
+	} {
+		var f BloomFilter
+		if _, err := f.ReadFromSparse(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// The delta of a filter of another size is rejected as well.
+	var delta bytes.Buffer
+	if _, err := New(1000, 4).AddString("x").WriteDelta(&delta, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := delta.Bytes()
+	binary.BigEndian.PutUint64(data[16:], 1020) // Size, still 16 words
+	if _, err := New(1000, 4).ApplyDelta(bytes.NewReader(data)); err == nil {
+		t.Error("expected an error applying a delta of another size")
+	}
+}
+
+func TestUnmarshalJSONDataLength(t *testing.T) {
+	for _, in := range []string{
+		`{"m":128,"k":4,"b":{"size":128,"data":[1]}}`,
+		`{"m":128,"k":4,"b":{"size":128,"data":[1,2,3]}}`,
+		`{"m":65,"k":4,"b":{"size":65,"data":[]}}`,
+	} {
+		var g BloomFilter
+		err := json.Unmarshal([]byte(in), &g)
+		if err == nil || !strings.Contains(err.Error(), "invalid data length") {
+			t.Errorf("Unmarshal(%s) = %v, want a data length error", in, err)
+		}
+	}
+	var g BloomFilter
+	if err := json.Unmarshal([]byte(`{"m":65,"k":4,"b":{"size":65,"data":[1,2]}}`), &g); err != nil {
+		t.Errorf("consistent JSON should decode: %v", err)
+	}
+}
+
+func TestUnmarshalJSONBase64Data(t *testing.T) {
+	f := New(200, 4)
+	for i := 0; i < 20; i++ {
+		f.AddString(fmt.Sprint(i))
+	}
+	f.bitset().data[1].Store(1<<62 | 1) // A word that float64 cannot hold exactly
+	var buf []byte
+	for i := range f.bitset().data {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(f.bitset().data[i].Load()))
+	}
+	legacy := fmt.Sprintf(`{"m":200,"k":4,"b":{"size":200,"data":%q}}`, base64.StdEncoding.EncodeToString(buf))
+	current, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fromLegacy, fromCurrent BloomFilter
+	if err := json.Unmarshal([]byte(legacy), &fromLegacy); err != nil {
+		t.Fatalf("base64 data should decode: %v", err)
+	}
+	if err := json.Unmarshal(current, &fromCurrent); err != nil {
+		t.Fatal(err)
+	}
+	if !fromLegacy.Equal(f) || !fromCurrent.Equal(f) {
+		t.Error("both representations should decode to the original filter")
+	}
+
+	for _, in := range []string{
+		`{"m":200,"k":4,"b":{"size":200,"data":"not base64!"}}`,
+		`{"m":200,"k":4,"b":{"size":200,"data":"AAAA"}}`,
+		`{"m":200,"k":4,"b":{"size":200,"data":"AAAAAAAAAAA="}}`,
+		`{"m":200,"k":4,"b":{"size":200,"data":7}}`,
+	} {
+		var g BloomFilter
+		if err := json.Unmarshal([]byte(in), &g); err == nil {
+			t.Errorf("Unmarshal(%s) should fail", in)
+		}
+	}
+}
+
 func TestEqual(t *testing.T) {
 	f := New(1000, 4)
 	f1 := New(1000, 4)
@@ -508,6 +1556,83 @@ func BenchmarkCombinedTestAndAdd(b *testing.B) {
 	}
 }
 
+func TestAddCounting(t *testing.T) {
+	f := New(1000, 4)
+	total := 0
+	for i := 0; i < 200; i++ {
+		total += f.AddCounting([]byte(fmt.Sprintf("key%d", i)))
+	}
+	if uint(total) != f.bitset().Count() {
+		t.Errorf("summed new bits %d != Count() %d", total, f.bitset().Count())
+	}
+	if n := f.AddCounting([]byte("key0")); n != 0 {
+		t.Errorf("re-adding an existing key set %d new bits", n)
+	}
+}
+
+func TestEstimateUnionFillRatio(t *testing.T) {
+	filters := make([]*BloomFilter, 5)
+	merged := New(5000, 4)
+	for i := range filters {
+		filters[i] = New(5000, 4)
+		for j := 0; j < 100; j++ {
+			filters[i].AddString(fmt.Sprint(i*50 + j)) // overlapping ranges
+		}
+		merged.Merge(filters[i])
+	}
+	got, err := EstimateUnionFillRatio(filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := merged.Health().FillRatio; got != want {
+		t.Errorf("EstimateUnionFillRatio = %v, merged filter has %v", got, want)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { EstimateUnionFillRatio(filters) }); allocs != 0 {
+		t.Errorf("EstimateUnionFillRatio allocates %v times", allocs)
+	}
+
+	if _, err := EstimateUnionFillRatio(nil); err == nil {
+		t.Error("expected an error for no filters")
+	}
+	var pm *ParamMismatch
+	if _, err := EstimateUnionFillRatio([]*BloomFilter{filters[0], New(5000, 3)}); !errors.As(err, &pm) {
+		t.Errorf("expected a *ParamMismatch, got %v", err)
+	}
+}
+
+func TestParamMismatch(t *testing.T) {
+	f := New(1000, 4)
+	tests := []struct {
+		g    *BloomFilter
+		want ParamMismatch
+		msg  string
+	}{
+		{New(2000, 4), ParamMismatch{FieldM, 1000, 2000}, "m's don't match: 1000 != 2000"},
+		{New(1000, 5), ParamMismatch{FieldK, 4, 5}, "k's don't match: 4 != 5"},
+		{NewWithSalt(1000, 4, []byte("s")), ParamMismatch{Field: FieldSalt}, "salts don't match"},
+	}
+	for _, tt := range tests {
+		_, errUnderFP := f.MergeIfUnderFP(tt.g, 1)
+		_, errXOR := f.SymmetricDifference(tt.g)
+		for _, err := range []error{f.Merge(tt.g), UnionInto(f, tt.g, New(1000, 4)), errUnderFP, errXOR} {
+			var pm *ParamMismatch
+			if !errors.As(err, &pm) {
+				t.Errorf("%v: want a *ParamMismatch, got %v", tt.want.Field, err)
+				continue
+			}
+			if *pm != tt.want {
+				t.Errorf("got %+v, want %+v", *pm, tt.want)
+			}
+			if err.Error() != tt.msg {
+				t.Errorf("got message %q, want %q", err.Error(), tt.msg)
+			}
+		}
+	}
+	if FieldK.String() != "k" || ParamField(9).String() != "ParamField(9)" {
+		t.Error("unexpected ParamField names")
+	}
+}
+
 func TestMerge(t *testing.T) {
 	f := New(1000, 4)
 	n1 := []byte("f")
@@ -540,50 +1665,1307 @@ func TestMerge(t *testing.T) {
 		t.Errorf("There should be an error when merging filters with mismatched k")
 	}
 
-	n2b := f.Test(n2)
-	if !n2b {
-		t.Errorf("The value doesn't exist after a valid merge")
+	n2b := f.Test(n2)
+	if !n2b {
+		t.Errorf("The value doesn't exist after a valid merge")
+	}
+
+	n3b := f.Test(n3)
+	if n3b {
+		t.Errorf("The value exists after an invalid merge")
+	}
+
+	n4b := f.Test(n4)
+	if n4b {
+		t.Errorf("The value exists after an invalid merge")
+	}
+}
+
+func TestMergeUnsafe(t *testing.T) {
+	f := New(1000, 4)
+	g := New(1000, 4)
+	f.AddString("f")
+	g.AddString("g")
+	want := f.Copy()
+	if err := want.Merge(g); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.MergeUnsafe(g); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Equal(want) {
+		t.Error("MergeUnsafe differs from Merge")
+	}
+	var pm *ParamMismatch
+	if err := f.MergeUnsafe(New(999, 4)); !errors.As(err, &pm) || pm.Field != FieldM {
+		t.Errorf("expected an m mismatch, got %v", err)
+	}
+}
+
+func TestUnionCount(t *testing.T) {
+	f := New(1000, 4)
+	g := New(1000, 4)
+	for i := 0; i < 100; i++ {
+		f.AddString(fmt.Sprint(i))
+		g.AddString(fmt.Sprint(i + 50))
+	}
+	before := f.Count()
+	got, err := f.UnionCount(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := f.Copy()
+	if err := merged.Merge(g); err != nil {
+		t.Fatal(err)
+	}
+	if got != merged.Count() {
+		t.Errorf("UnionCount = %d, merged filter has %d bits set", got, merged.Count())
+	}
+	if f.Count() != before {
+		t.Error("UnionCount should not modify f")
+	}
+	if n := testing.AllocsPerRun(10, func() { f.UnionCount(g) }); n != 0 {
+		t.Errorf("UnionCount allocates %v times", n)
+	}
+	var pm *ParamMismatch
+	if _, err := f.UnionCount(New(1000, 5)); !errors.As(err, &pm) || pm.Field != FieldK {
+		t.Errorf("expected a k mismatch, got %v", err)
+	}
+}
+
+func TestEstimateIntersectionSize(t *testing.T) {
+	// fill builds a filter holding the integers [from, to).
+	fill := func(from, to int) *BloomFilter {
+		f := New(100000, 4)
+		for i := from; i < to; i++ {
+			f.AddUint64(uint64(i))
+		}
+		return f
+	}
+	for _, c := range []struct {
+		a, b      [2]int
+		intersect int
+	}{
+		{[2]int{0, 3000}, [2]int{2000, 5000}, 1000},
+		{[2]int{0, 3000}, [2]int{0, 3000}, 3000},
+		{[2]int{0, 5000}, [2]int{1000, 2000}, 1000},
+		{[2]int{0, 3000}, [2]int{3000, 6000}, 0},
+	} {
+		f, g := fill(c.a[0], c.a[1]), fill(c.b[0], c.b[1])
+		got, err := f.EstimateIntersectionSize(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		union := max(uint(c.a[1]), uint(c.b[1])) - min(uint(c.a[0]), uint(c.b[0]))
+		if math.Abs(float64(got-int64(c.intersect))) > 0.02*float64(union) {
+			t.Errorf("%v ∩ %v: estimated %d, want about %d", c.a, c.b, got, c.intersect)
+		}
+		u, err := f.EstimateUnionSize(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(float64(u)-float64(union)) > 0.02*float64(union) {
+			t.Errorf("%v ∪ %v: estimated %d, want about %d", c.a, c.b, u, union)
+		}
+	}
+	var pm *ParamMismatch
+	if _, err := New(1000, 4).EstimateIntersectionSize(New(1000, 3)); !errors.As(err, &pm) {
+		t.Errorf("expected a *ParamMismatch, got %v", err)
+	}
+	if _, err := New(1000, 4).EstimateUnionSize(New(999, 4)); !errors.As(err, &pm) {
+		t.Errorf("expected a *ParamMismatch, got %v", err)
+	}
+}
+
+func TestMergeable(t *testing.T) {
+	f := New(1000, 4)
+	if !f.Mergeable(New(1000, 4)) {
+		t.Error("filters with matching m and k should be mergeable")
+	}
+	if f.Mergeable(New(999, 4)) {
+		t.Error("filters with mismatched m should not be mergeable")
+	}
+	if f.Mergeable(New(1000, 5)) {
+		t.Error("filters with mismatched k should not be mergeable")
+	}
+}
+
+func TestMergeFromReaders(t *testing.T) {
+	// m spans more than one chunk of words.
+	const m, k = 50000, 5
+	want := New(m, k)
+	var streams []io.Reader
+	for i := 0; i < 3; i++ {
+		g := New(m, k)
+		for j := 0; j < 500; j++ {
+			g.AddString(fmt.Sprintf("%d-%d", i, j))
+		}
+		if err := want.Merge(g); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := g.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, &buf)
+	}
+
+	f := New(m, k)
+	f.AddString("already here")
+	want.AddString("already here")
+	if err := MergeFromReaders(f, streams...); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Equal(want) {
+		t.Error("streamed merge differs from Merge")
+	}
+	if f.IsEmpty() || !f.TestString("2-499") {
+		t.Error("merged content is missing")
+	}
+
+	var other bytes.Buffer
+	if _, err := New(m, k+1).WriteTo(&other); err != nil {
+		t.Fatal(err)
+	}
+	var pm *ParamMismatch
+	if err := MergeFromReaders(f, &other); !errors.As(err, &pm) || pm.Field != FieldK {
+		t.Errorf("expected a k mismatch, got %v", err)
+	}
+
+	var truncated bytes.Buffer
+	if _, err := want.WriteTo(&truncated); err != nil {
+		t.Fatal(err)
+	}
+	truncated.Truncate(truncated.Len() - 8)
+	if err := MergeFromReaders(New(m, k), &truncated); err == nil {
+		t.Error("expected an error merging a truncated stream")
+	}
+}
+
+func TestMergeIfUnderFP(t *testing.T) {
+	f := New(1000, 4)
+	g := New(1000, 4)
+	for i := 0; i < 60; i++ {
+		f.AddString(fmt.Sprintf("f%d", i))
+		g.AddString(fmt.Sprintf("g%d", i))
+	}
+	union := f.Copy()
+	if err := union.Merge(g); err != nil {
+		t.Fatal(err)
+	}
+	projected := union.Health().EstimatedFP
+	before := f.Copy()
+
+	merged, err := f.MergeIfUnderFP(g, projected*0.99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged || !f.Equal(before) {
+		t.Error("merge past the fp budget should be refused and leave f unchanged")
+	}
+	merged, err = f.MergeIfUnderFP(g, projected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !merged || !f.Equal(union) {
+		t.Error("merge right at the fp budget should happen")
+	}
+
+	if _, err := f.MergeIfUnderFP(New(1000, 5), 1); err == nil {
+		t.Error("There should be an error when merging filters with mismatched k")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	f := From([]int64{0b1100, -1, 0}, 3)
+	g := From([]int64{0b1010, -1, -1 << 63}, 3)
+	d, err := f.Diff(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FilterDiff{OnlyF: 1, OnlyG: 2, Both: 65, Hamming: 3}
+	if d != want {
+		t.Errorf("Diff() = %+v, want %+v", d, want)
+	}
+	if back, _ := g.Diff(f); back.OnlyF != d.OnlyG || back.OnlyG != d.OnlyF || back.Hamming != d.Hamming {
+		t.Errorf("g.Diff(f) = %+v, want the mirror of %+v", back, d)
+	}
+	if same, _ := f.Diff(f.Copy()); same != (FilterDiff{Both: f.Count()}) {
+		t.Errorf("Diff of a copy = %+v, want only common bits", same)
+	}
+
+	// A lagging replica only misses bits.
+	primary := New(10000, 4)
+	for i := 0; i < 100; i++ {
+		primary.AddString(fmt.Sprint(i))
+	}
+	replica := primary.Copy()
+	for i := 100; i < 150; i++ {
+		primary.AddString(fmt.Sprint(i))
+	}
+	if d, _ := primary.Diff(replica); d.OnlyF == 0 || d.OnlyG != 0 || d.Both != replica.Count() {
+		t.Errorf("lagging replica: Diff() = %+v", d)
+	}
+
+	var pm *ParamMismatch
+	if _, err := f.Diff(From([]int64{0, 0, 0}, 4)); !errors.As(err, &pm) || pm.Field != FieldK {
+		t.Errorf("Diff with a different k = %v, want a k mismatch", err)
+	}
+}
+
+func TestMergeRehash(t *testing.T) {
+	f := New(10000, 5)
+	g := New(10000, 3)
+	var fItems, gItems [][]byte
+	for i := 0; i < 200; i++ {
+		fItems = append(fItems, []byte(fmt.Sprintf("f%d", i)))
+		gItems = append(gItems, []byte(fmt.Sprintf("g%d", i)))
+	}
+	f.AddBatch(fItems)
+	g.AddBatch(gItems)
+	if err := f.Merge(g); err == nil {
+		t.Fatal("Merge should reject filters with different k")
+	}
+	if err := f.MergeRehash(g, gItems); err != nil {
+		t.Fatal(err)
+	}
+	for _, items := range [][][]byte{fItems, gItems} {
+		for _, item := range items {
+			if !f.Test(item) {
+				t.Fatalf("%s is missing after MergeRehash", item)
+			}
+		}
+	}
+	if f.K() != 5 {
+		t.Errorf("K() = %d after MergeRehash, want 5", f.K())
+	}
+
+	var pm *ParamMismatch
+	if err := f.MergeRehash(New(9999, 5), nil); !errors.As(err, &pm) || pm.Field != FieldM {
+		t.Errorf("MergeRehash with a different m = %v, want an m mismatch", err)
+	}
+}
+
+func TestUnionInto(t *testing.T) {
+	a := New(1000, 4)
+	b := New(1000, 4)
+	dst := New(1000, 4)
+	a.AddString("a")
+	b.AddString("b")
+	dst.AddString("stale")
+
+	if err := UnionInto(a, b, dst); err != nil {
+		t.Fatal(err)
+	}
+	want := a.Copy()
+	if err := want.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if !dst.Equal(want) {
+		t.Error("dst should hold exactly a|b")
+	}
+
+	if err := UnionInto(a, New(999, 4), dst); err == nil {
+		t.Error("There should be an error when b has mismatched m")
+	}
+	if err := UnionInto(a, b, New(1000, 5)); err == nil {
+		t.Error("There should be an error when dst has mismatched k")
+	}
+	if err := UnionInto(New(1000, 5), b, dst); err == nil {
+		t.Error("There should be an error when a has mismatched k")
+	}
+}
+
+func BenchmarkUnionInto(b *testing.B) {
+	x, y, dst := New(1<<20, 4), New(1<<20, 4), New(1<<20, 4)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = UnionInto(x, y, dst)
+	}
+}
+
+func BenchmarkCopyMerge(b *testing.B) {
+	x, y := New(1<<20, 4), New(1<<20, 4)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = x.Copy().Merge(y)
+	}
+}
+
+func TestMergeConcurrentSource(t *testing.T) {
+	g := New(10000, 4)
+	for i := 0; i < 100; i++ {
+		g.AddString(fmt.Sprintf("before%d", i))
+	}
+
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			g.AddString(fmt.Sprintf("during%d", i))
+		}
+	}()
+	for r := 0; r < 100; r++ {
+		f := New(10000, 4)
+		if err := f.Merge(g); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if !f.TestString(fmt.Sprintf("before%d", i)) {
+				t.Fatalf("before%d added ahead of Merge is missing", i)
+			}
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+func TestWriteToConcurrentAdd(t *testing.T) {
+	g := NewWithSalt(10000, 4, []byte("salt"))
+	for i := 0; i < 100; i++ {
+		g.AddString(fmt.Sprintf("before%d", i))
+	}
+
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			g.AddString(fmt.Sprintf("during%d", i))
+		}
+	}()
+	for r := 0; r < 50; r++ {
+		for name, write := range map[string]func(io.Writer) (int64, error){
+			"WriteTo":           g.WriteTo,
+			"WriteToConsistent": g.WriteToConsistent,
+		} {
+			var buf bytes.Buffer
+			n, err := write(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(buf.Len()) || n != g.SerializedSize() {
+				t.Fatalf("%s reported %d bytes, wrote %d", name, n, buf.Len())
+			}
+			var f BloomFilter
+			if _, err := f.ReadFrom(&buf); err != nil {
+				t.Fatalf("%s output does not decode: %v", name, err)
+			}
+			if !f.Mergeable(g) {
+				t.Fatalf("%s output has different parameters", name)
+			}
+			for i := 0; i < 100; i++ {
+				if !f.TestString(fmt.Sprintf("before%d", i)) {
+					t.Fatalf("before%d added ahead of %s is missing", i, name)
+				}
+			}
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+func TestWordAtRoundTrip(t *testing.T) {
+	f := NewWithSalt(1000, 4, []byte("s"))
+	for i := 0; i < 100; i++ {
+		f.AddString(fmt.Sprint(i))
+	}
+	if n := f.NumWords(); n != 16 {
+		t.Fatalf("NumWords() = %d, want 16", n)
+	}
+	words := make([]uint64, f.NumWords())
+	for i := range words {
+		words[i] = f.WordAt(i)
+	}
+
+	g := NewWithSalt(1000, 4, []byte("s"))
+	g.MarkClean()
+	for i, w := range words {
+		g.SetWordAt(i, w)
+	}
+	if !g.Equal(f) || g.IsEmpty() || !g.IsDirty() {
+		t.Error("filter paged back in differs from the original")
+	}
+	for i := 0; i < 100; i++ {
+		if !g.TestString(fmt.Sprint(i)) {
+			t.Fatalf("%d is missing after paging in", i)
+		}
+	}
+
+	// Word 3 holds bits 192..255.
+	h := New(1000, 4)
+	h.SetWordAt(3, 1<<5)
+	if !h.BitSet().Test(197) || h.BitSet().Count() != 1 {
+		t.Error("word 3 should hold bit 197")
+	}
+	// Bits past m in the last word are dropped.
+	h.SetWordAt(15, ^uint64(0))
+	if got := h.WordAt(15); got != 1<<(1000%64)-1 {
+		t.Errorf("last word is %x, bits past m should be clear", got)
+	}
+	h.SetWordAt(-1, 1)
+	h.SetWordAt(16, 1)
+	if h.WordAt(-1) != 0 || h.WordAt(16) != 0 || h.BitSet().Count() != 1+1000%64 {
+		t.Error("out-of-range words should be ignored")
+	}
+}
+
+func TestSwapBitSet(t *testing.T) {
+	f := New(1000, 4)
+	f.AddString("old")
+	g := New(1000, 4)
+	g.AddString("new")
+
+	old, err := f.SwapBitSet(g.BitSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.TestString("new") || f.TestString("old") {
+		t.Error("filter should use the swapped-in bitset")
+	}
+	if _, err := f.SwapBitSet(old); err != nil {
+		t.Fatal(err)
+	}
+	if !f.TestString("old") {
+		t.Error("swapping back should restore the original bitset")
+	}
+
+	if _, err := f.SwapBitSet(New(999, 4).BitSet()); err == nil {
+		t.Error("There should be an error when swapping in a bitset of another size")
+	}
+	if _, err := f.SwapBitSet(nil); err == nil {
+		t.Error("There should be an error when swapping in a nil bitset")
+	}
+}
+
+func TestRefreshConcurrentReaders(t *testing.T) {
+	const gens, perGen = 50, 200
+	items := func(gen int) [][]byte {
+		out := make([][]byte, perGen)
+		for i := range out {
+			out[i] = []byte(fmt.Sprintf("%d-%d", gen, i))
+		}
+		return out
+	}
+	f := NewWithSalt(1<<16, 4, []byte("refresh"))
+	f.Refresh(items(0))
+
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				// Check a single generation against one snapshot of the bits.
+				snap := newFilter(f.m, f.k, f.BitSet())
+				snap.setSalt(f.salt)
+				gen := -1
+				for g := 0; g < gens; g++ {
+					if snap.TestString(fmt.Sprintf("%d-0", g)) {
+						gen = g
+						break
+					}
+				}
+				if gen < 0 {
+					t.Error("no generation is present")
+					return
+				}
+				if !snap.TestAll(items(gen)) {
+					t.Errorf("generation %d is only partially present", gen)
+					return
+				}
+			}
+		}()
+	}
+	for g := 1; g < gens; g++ {
+		f.Refresh(items(g))
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	if !f.TestAll(items(gens - 1)) {
+		t.Error("the last generation should be present")
+	}
+	if f.TestAll(items(0)) {
+		t.Error("Refresh should drop the previous contents")
+	}
+}
+
+func TestSwapBitSetConcurrentDecode(t *testing.T) {
+	// Decoding into a filter replaces its bitset like SwapBitSet does; run
+	// with -race to check that the two don't race.
+	f := New(1000, 4)
+	data, err := New(1000, 4).AddString("decoded").MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			f.SwapBitSet(New(1000, 4).BitSet())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := f.UnmarshalBinary(data); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	if f.Cap() != 1000 {
+		t.Errorf("Cap() = %d, want 1000", f.Cap())
+	}
+}
+
+func TestSwapBitSetConcurrentReaders(t *testing.T) {
+	shared := make([][]byte, 100)
+	for i := range shared {
+		shared[i] = []byte(fmt.Sprintf("shared%d", i))
+	}
+	gens := make([]*atomicBitSet, 2)
+	for i := range gens {
+		g := New(10000, 4)
+		for _, key := range shared {
+			g.Add(key)
+		}
+		g.AddString(fmt.Sprintf("gen%d", i))
+		gens[i] = g.BitSet()
+	}
+	f := New(10000, 4)
+	if _, err := f.SwapBitSet(gens[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				for _, key := range shared {
+					if !f.Test(key) {
+						t.Errorf("%s missing during swap", key)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := f.SwapBitSet(gens[i%2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+func TestCopy(t *testing.T) {
+	f := New(1000, 4)
+	n1 := []byte("f")
+	f.Add(n1)
+
+	// copy here instead of New
+	g := f.Copy()
+	n2 := []byte("g")
+	g.Add(n2)
+
+	n1fb := f.Test(n1)
+	if !n1fb {
+		t.Errorf("The value doesn't exist in original after making a copy")
+	}
+
+	n1gb := g.Test(n1)
+	if !n1gb {
+		t.Errorf("The value doesn't exist in the copy")
+	}
+
+	n2fb := f.Test(n2)
+	if n2fb {
+		t.Errorf("The value exists in the original, it should only exist in copy")
+	}
+
+	n2gb := g.Test(n2)
+	if !n2gb {
+		t.Errorf("The value doesn't exist in copy after Add()")
+	}
+}
+
+func TestBitsPerElement(t *testing.T) {
+	for _, tt := range []struct{ fp, want float64 }{
+		{0.5, 1.4427},
+		{0.01, 9.5851},
+		{0.001, 14.3776},
+	} {
+		if got := BitsPerElementFor(tt.fp); math.Abs(got-tt.want) > 0.001 {
+			t.Errorf("BitsPerElementFor(%v) = %v, want %v", tt.fp, got, tt.want)
+		}
+	}
+
+	if got := New(1000, 4).BitsPerElement(); got != 0 {
+		t.Errorf("empty filter has %v bits per element, want 0", got)
+	}
+	const n = 10000
+	f := NewWithEstimates(n, 0.01)
+	for i := 0; i < n; i++ {
+		f.AddString(fmt.Sprint(i))
+	}
+	got, want := f.BitsPerElement(), float64(f.Cap())/n
+	if math.Abs(got-want)/want > 0.05 {
+		t.Errorf("BitsPerElement() = %v, want about %v", got, want)
+	}
+	if math.Abs(got-BitsPerElementFor(0.01)) > 0.5 {
+		t.Errorf("a filter provisioned for 1%% has %v bits per element, want about %v", got, BitsPerElementFor(0.01))
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	fill := func(f *BloomFilter, n int) *BloomFilter {
+		for i := 0; i < n; i++ {
+			f.AddString(fmt.Sprint(i))
+		}
+		return f
+	}
+	tests := []struct {
+		name string
+		f    *BloomFilter
+		want []string // substrings, one per expected warning
+	}{
+		{"well configured", fill(NewWithEstimates(1000, 0.01), 1000), nil},
+		{"empty", NewWithEstimates(1000, 0.01), nil},
+		{"k exceeds m", New(8, 64), []string{"exceeds m", "below 64 bits"}},
+		{"m too small", New(32, 2), []string{"below 64 bits"}},
+		{"k too large", fill(New(1000, 30), 100), []string{"far from the optimal"}},
+		{"k too small", fill(New(100000, 1), 100), []string{"far from the optimal"}},
+	}
+	for _, tt := range tests {
+		got := tt.f.Warnings()
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got warnings %q, want %d", tt.name, got, len(tt.want))
+			continue
+		}
+		for i, w := range tt.want {
+			if !strings.Contains(got[i], w) {
+				t.Errorf("%s: warning %q should mention %q", tt.name, got[i], w)
+			}
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	build := func(from, to int) *BloomFilter {
+		f := New(1<<16, 4)
+		for i := from; i < to; i++ {
+			f.AddString(fmt.Sprint(i))
+		}
+		return f
+	}
+	shared := func(a, b []uint64) int {
+		n := 0
+		for _, x := range a {
+			if slices.Contains(b, x) {
+				n++
+			}
+		}
+		return n
+	}
+
+	a := build(0, 1000)
+	near := build(100, 1100) // 90% overlap with a
+	far := build(500, 1500)  // 50% overlap with a
+	other := build(2000, 3000)
+
+	const n = 64
+	sa := a.Signature(n)
+	if len(sa) != n {
+		t.Fatalf("got %d indices, want %d", len(sa), n)
+	}
+	if !slices.IsSorted(sa) {
+		t.Error("signature should be sorted")
+	}
+	for _, i := range sa {
+		if !a.BitSet().Test(uint(i)) {
+			t.Errorf("signature index %d is not set", i)
+		}
+	}
+	if c := shared(sa, a.Signature(n)); c != n {
+		t.Errorf("identical filters share %d of %d indices", c, n)
+	}
+	sNear, sFar, sOther := shared(sa, near.Signature(n)), shared(sa, far.Signature(n)), shared(sa, other.Signature(n))
+	if !(sNear > sFar && sFar > sOther) {
+		t.Errorf("shared indices should decrease with overlap: near %d, far %d, disjoint %d", sNear, sFar, sOther)
+	}
+
+	if got := New(100, 3).Signature(10); len(got) != 0 {
+		t.Errorf("empty filter signature %v, want none", got)
+	}
+	if got := a.Signature(0); got != nil {
+		t.Errorf("Signature(0) = %v, want nil", got)
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	f := New(1000, 4)
+	for i := 0; i < 50; i++ {
+		f.AddString(fmt.Sprint(i))
+	}
+	var buf bytes.Buffer
+	if err := f.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); uint(lines) != 1+f.BitSet().Count() {
+		t.Errorf("got %d lines, want a header plus %d indices", lines, f.BitSet().Count())
+	}
+	var g BloomFilter
+	if err := g.ReadCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Equal(&g) {
+		t.Error("filter does not survive a CSV round trip")
+	}
+}
+
+func TestReadCSVHandWritten(t *testing.T) {
+	var f BloomFilter
+	if err := f.ReadCSV(strings.NewReader("100,3\n0\n17\r\n99\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := New(100, 3)
+	want.bitset().Set(0)
+	want.bitset().Set(17)
+	want.bitset().Set(99)
+	if !f.Equal(want) {
+		t.Errorf("got %v, want %v", &f, want)
+	}
+	if f.IsDirty() || f.IsEmpty() {
+		t.Errorf("read filter: IsDirty() = %v, IsEmpty() = %v, want false, false", f.IsDirty(), f.IsEmpty())
+	}
+	var empty BloomFilter
+	if err := empty.ReadCSV(strings.NewReader("100,3\n")); err != nil || !empty.IsEmpty() || empty.IsDirty() {
+		t.Errorf("empty filter: err = %v, IsEmpty() = %v, IsDirty() = %v", err, empty.IsEmpty(), empty.IsDirty())
+	}
+
+	for _, in := range []string{"", "100\n", "0,3\n", "100,0\n", "100,0,ab\n", "100,3\n100\n", "100,3\nx\n", "100,3\n1,2\n", "9000000000000000000,3\n", "18446744073709551615,3\n"} {
+		if err := new(BloomFilter).ReadCSV(strings.NewReader(in)); err == nil {
+			t.Errorf("ReadCSV(%q) should fail", in)
+		}
+	}
+}
+
+func TestOnFillThreshold(t *testing.T) {
+	f := New(1000, 4)
+	f.AddString("before")
+	var fired atomic.Int32
+	var fillAtFire float64
+	f.OnFillThreshold(0.5, func() {
+		fired.Add(1)
+		fillAtFire = f.Health().FillRatio
+	})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				f.AddString(fmt.Sprintf("%d-%d", w, i))
+			}
+		}(w)
+	}
+	wg.Wait()
+	if f.Health().FillRatio < 0.5 {
+		t.Fatalf("fill ratio %v did not cross the threshold", f.Health().FillRatio)
+	}
+	if n := fired.Load(); n != 1 {
+		t.Fatalf("callback fired %d times, want 1", n)
+	}
+	if fillAtFire < 0.5 {
+		t.Errorf("callback fired at fill ratio %v, before the threshold", fillAtFire)
+	}
+	f.AddString("after")
+	if n := fired.Load(); n != 1 {
+		t.Errorf("callback fired %d times after more adds, want 1", n)
+	}
+}
+
+func TestOnFillThresholdMerge(t *testing.T) {
+	g := New(1000, 4)
+	for i := 0; g.Health().FillRatio < 0.6; i++ {
+		g.AddString(fmt.Sprint("g", i))
+	}
+	for name, merge := range map[string]func(f *BloomFilter) error{
+		"Merge":       func(f *BloomFilter) error { return f.Merge(g) },
+		"MergeUnsafe": func(f *BloomFilter) error { return f.MergeUnsafe(g) },
+		"UnionInto":   func(f *BloomFilter) error { return UnionInto(f, g, f) },
+		"ApplyDelta": func(f *BloomFilter) error {
+			var delta bytes.Buffer
+			if _, err := g.WriteDelta(&delta, nil); err != nil {
+				return err
+			}
+			_, err := f.ApplyDelta(&delta)
+			return err
+		},
+	} {
+		f := New(1000, 4).AddString("before")
+		var fired atomic.Int32
+		var fillAtFire float64
+		f.OnFillThreshold(0.5, func() {
+			fired.Add(1)
+			fillAtFire = f.Health().FillRatio
+		})
+		if err := merge(f); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if n := fired.Load(); n != 1 {
+			t.Errorf("%s: callback fired %d times after crossing the threshold, want 1", name, n)
+		}
+		if fillAtFire < 0.5 {
+			t.Errorf("%s: callback fired at fill ratio %v, before the threshold", name, fillAtFire)
+		}
+		for i := 0; i < 10; i++ {
+			f.AddString(fmt.Sprint("after", i))
+		}
+		if n := fired.Load(); n != 1 {
+			t.Errorf("%s: callback fired %d times after more adds, want 1", name, n)
+		}
+	}
+
+	// UnionInto overwrites dst, and the bits it clears come off the count:
+	// after emptying f, merging g back brings it to 0.6 again, not 1.2.
+	f := New(1000, 4)
+	f.Merge(g)
+	var fired atomic.Int32
+	f.OnFillThreshold(0.7, func() { fired.Add(1) })
+	if err := UnionInto(New(1000, 4), New(1000, 4).AddString("x"), f); err != nil {
+		t.Fatal(err)
+	}
+	f.Merge(g)
+	if n := fired.Load(); n != 0 {
+		t.Errorf("callback fired %d times below the threshold, want 0", n)
+	}
+}
+
+func TestOnFillThresholdSetWordAt(t *testing.T) {
+	f := New(1024, 4)
+	var fired atomic.Int32
+	f.OnFillThreshold(0.5, func() { fired.Add(1) })
+	// Page in 448 bits, overwrite them with zeros, then page in 384 bits
+	// elsewhere: the fill never goes past 448 of 1024.
+	for i := 0; i < 7; i++ {
+		f.SetWordAt(i, ^uint64(0))
+	}
+	for i := 0; i < 7; i++ {
+		f.SetWordAt(i, 0)
+	}
+	for i := 7; i < 13; i++ {
+		f.SetWordAt(i, ^uint64(0))
+	}
+	if n := fired.Load(); n != 0 {
+		t.Errorf("callback fired %d times below the threshold, want 0", n)
+	}
+	for i := 0; i < 2; i++ {
+		f.SetWordAt(i, ^uint64(0))
+	}
+	if n := fired.Load(); n != 1 {
+		t.Errorf("callback fired %d times after crossing the threshold, want 1", n)
+	}
+}
+
+func TestOnFillThresholdRemove(t *testing.T) {
+	f := New(100, 4)
+	fired := false
+	f.OnFillThreshold(0.01, func() { fired = true })
+	f.OnFillThreshold(0.01, nil)
+	f.AddString("x")
+	if fired {
+		t.Error("removed callback should not fire")
+	}
+}
+
+func TestSalt(t *testing.T) {
+	const n = 200
+	a := NewWithSalt(10000, 5, []byte("users.example.com"))
+	b := NewWithSalt(10000, 5, []byte("orders.example.com"))
+	plain := New(10000, 5)
+	same := 0
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint(i))
+		a.Add(key)
+		b.Add(key)
+		plain.Add(key)
+		if !a.Test(key) || !b.Test(key) {
+			t.Fatalf("%s should be in.", key)
+		}
+		// The same key should land on different bits with each salt.
+		h := baseHashes(key)
+		if slices.Equal(locationsOf(a, a.salted(h)), locationsOf(b, b.salted(h))) {
+			same++
+		}
+		// AddHash and TestHash take unsalted base hashes.
+		if !a.TestHash(h) {
+			t.Errorf("TestHash(baseHashes(%s)) should be true", key)
+		}
+	}
+	if same > 0 {
+		t.Errorf("%d of %d keys have identical locations under two salts", same, n)
+	}
+	if a.BitSet().Equal(b.BitSet()) || a.BitSet().Equal(plain.BitSet()) {
+		t.Error("salted filters should set different bits")
+	}
+	if !TestAcrossAny([]*BloomFilter{plain, b}, []byte("7")) {
+		t.Error("TestAcrossAny should apply each filter's salt")
+	}
+	if NewWithSalt(100, 3, nil).Salt() != nil || !New(100, 3).Equal(NewWithSalt(100, 3, []byte{})) {
+		t.Error("an empty salt should be the same as none")
+	}
+	if err := a.Merge(b); err == nil {
+		t.Error("expected an error merging filters with different salts")
+	}
+	if !a.Copy().Equal(a) || !bytes.Equal(a.Copy().Salt(), a.Salt()) {
+		t.Error("Copy should keep the salt")
+	}
+	if o := NewWithOptions(Options{M: 10000, K: 5, Salt: []byte("users.example.com")}); !o.AddString("x").TestString("x") || !bytes.Equal(o.Salt(), a.Salt()) {
+		t.Error("Options.Salt should salt the filter")
+	}
+}
+
+func locationsOf(f *BloomFilter, h [4]uint64) []uint {
+	locs := make([]uint, f.k)
+	for i := range locs {
+		locs[i] = f.location(h, uint(i))
+	}
+	return locs
+}
+
+func TestSaltPersisted(t *testing.T) {
+	f := NewWithSalt(1000, 4, []byte("salt"))
+	f.AddString("key")
+
+	var buf bytes.Buffer
+	written, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != f.SerializedSize() {
+		t.Errorf("wrote %d bytes, SerializedSize says %d", written, f.SerializedSize())
+	}
+	if m, k, err := ReadHeader(bytes.NewReader(buf.Bytes())); err != nil || m != 1000 || k != 4 {
+		t.Errorf("ReadHeader = %d, %d, %v", m, k, err)
+	}
+	var g BloomFilter
+	if _, err := g.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var sparse bytes.Buffer
+	if _, err := f.WriteToSparse(&sparse); err != nil {
+		t.Fatal(err)
+	}
+	var h BloomFilter
+	if _, err := h.ReadFromSparse(&sparse); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j BloomFilter
+	if err := json.Unmarshal(data, &j); err != nil {
+		t.Fatal(err)
+	}
+
+	var csvBuf bytes.Buffer
+	if err := f.WriteCSV(&csvBuf); err != nil {
+		t.Fatal(err)
+	}
+	var c BloomFilter
+	if err := c.ReadCSV(&csvBuf); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, r := range map[string]*BloomFilter{"binary": &g, "sparse": &h, "JSON": &j, "CSV": &c} {
+		if !f.Equal(r) || !r.TestString("key") || r.TestString("other") {
+			t.Errorf("salted filter does not survive a %s round trip", name)
+		}
+	}
+
+	// Reading an unsalted filter into a salted one drops the salt.
+	buf.Reset()
+	if _, err := New(1000, 4).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.ReadFrom(&buf); err != nil || g.Salt() != nil {
+		t.Errorf("reading an unsalted filter should clear the salt: %v", err)
+	}
+}
+
+func TestSymmetricDifference(t *testing.T) {
+	f := New(1000, 4)
+	g := New(1000, 4)
+	for i := 0; i < 20; i++ {
+		f.AddString(fmt.Sprint(i))
+		g.AddString(fmt.Sprint(i))
+	}
+	d, err := f.SymmetricDifference(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.BitSet().Count() != 0 {
+		t.Errorf("shared bits should cancel out, %d left", d.BitSet().Count())
+	}
+
+	g.AddString("only in g")
+	before := f.Copy()
+	d, err = f.SymmetricDifference(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := g.BitSet().Count() - f.BitSet().Count(); d.BitSet().Count() != want {
+		t.Errorf("difference has %d bits, want %d", d.BitSet().Count(), want)
+	}
+	for i, ok := d.bitset().NextSet(0); ok; i, ok = d.bitset().NextSet(i + 1) {
+		if f.bitset().Test(i) || !g.bitset().Test(i) {
+			t.Errorf("bit %d should be set in g only", i)
+		}
+	}
+	if !f.Equal(before) {
+		t.Error("SymmetricDifference must not modify its receiver")
+	}
+
+	if _, err := f.SymmetricDifference(New(1000, 5)); err == nil {
+		t.Error("expected an error for mismatched parameters")
+	}
+}
+
+func TestTestReaderTo(t *testing.T) {
+	f := New(1000, 4)
+	f.AddString("apple")
+	f.AddString("cherry")
+	f.AddString("")
+	in := "apple\nbanana\r\ncherry\n\ndurian"
+	var out bytes.Buffer
+	if err := f.TestReaderTo(strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "1\n0\n1\n1\n0\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	if err := f.TestReaderTo(strings.NewReader(""), &out); err != nil || out.Len() != 0 {
+		t.Errorf("empty input should produce no output, got %q, %v", out.String(), err)
+	}
+}
+
+func TestAddUint64(t *testing.T) {
+	f := New(10000, 4)
+	g := New(10000, 4)
+	for _, x := range []uint64{0, 1, 255, 1 << 32, math.MaxUint64} {
+		f.AddUint64(x)
+		g.Add(binary.BigEndian.AppendUint64(nil, x))
+		if !f.TestUint64(x) || !g.TestUint64(x) {
+			t.Errorf("%d should be present", x)
+		}
+	}
+	if !f.Equal(g) {
+		t.Error("AddUint64 should set the same bits as adding the encoded bytes")
+	}
+	if f.TestUint64(2) {
+		t.Error("2 was never added")
+	}
+	if n := testing.AllocsPerRun(100, func() { f.AddUint64(7) }); n != 0 {
+		t.Errorf("AddUint64 allocates %v times", n)
+	}
+}
+
+func TestTestProbes(t *testing.T) {
+	f := New(1000, 5)
+	if present, probes := f.TestProbes([]byte("x")); present || probes != 1 {
+		t.Errorf("empty filter: got present=%v after %d probes, want false after 1", present, probes)
+	}
+	f.AddString("x")
+	if present, probes := f.TestProbes([]byte("x")); !present || probes != 5 {
+		t.Errorf("added item: got present=%v after %d probes, want true after 5", present, probes)
+	}
+	for i := 0; i < 1000; i++ {
+		data := []byte(fmt.Sprint(i))
+		present, probes := f.TestProbes(data)
+		if present != f.Test(data) || probes < 1 || probes > 5 {
+			t.Fatalf("%q: got present=%v after %d probes, Test says %v", data, present, probes, f.Test(data))
+		}
+	}
+}
+
+func TestIsLikelyNew(t *testing.T) {
+	for _, f := range []*BloomFilter{NewWithEstimates(1000, 0.01), New(1000, 1), NewWithSalt(1000, 7, []byte("s"))} {
+		for i := 0; i < 1000; i++ {
+			f.AddString(fmt.Sprintf("in%d", i))
+		}
+		for i := 0; i < 1000; i++ {
+			if key := []byte(fmt.Sprintf("in%d", i)); f.IsLikelyNew(key) {
+				t.Fatalf("%s was added but reported as new", key)
+			}
+			if key := []byte(fmt.Sprintf("out%d", i)); f.IsLikelyNew(key) != !f.Test(key) {
+				t.Fatalf("IsLikelyNew(%s) disagrees with Test", key)
+			}
+		}
+	}
+}
+
+func BenchmarkIsLikelyNew(b *testing.B) {
+	f := NewWithEstimates(100000, 0.01)
+	for i := 0; i < 20000; i++ {
+		f.AddString(fmt.Sprintf("in%d", i))
+	}
+	key := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint32(key, uint32(i))
+		f.IsLikelyNew(key)
+	}
+}
+
+func BenchmarkNotTest(b *testing.B) {
+	f := NewWithEstimates(100000, 0.01)
+	for i := 0; i < 20000; i++ {
+		f.AddString(fmt.Sprintf("in%d", i))
+	}
+	key := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint32(key, uint32(i))
+		_ = !f.Test(key)
+	}
+}
+
+func TestAddAllDeduped(t *testing.T) {
+	var items [][]byte
+	for i := 0; i < 300; i++ {
+		items = append(items, []byte(fmt.Sprint(i%37)))
 	}
-
-	n3b := f.Test(n3)
-	if n3b {
-		t.Errorf("The value exists after an invalid merge")
+	f := New(1000, 4).AddAllDeduped(items)
+	g := New(1000, 4).AddBatch(items)
+	if !f.Equal(g) {
+		t.Error("AddAllDeduped should set the same bits as AddBatch")
 	}
-
-	n4b := f.Test(n4)
-	if n4b {
-		t.Errorf("The value exists after an invalid merge")
+	for _, item := range items {
+		if !f.Test(item) {
+			t.Errorf("%s should be in.", item)
+		}
 	}
 }
 
-func TestCopy(t *testing.T) {
+func TestStringUnsafe(t *testing.T) {
 	f := New(1000, 4)
-	n1 := []byte("f")
-	f.Add(n1)
+	g := New(1000, 4)
+	for _, s := range []string{"", "a", "fifteen chars!!", "sixteen chars!!!", "a somewhat longer string"} {
+		f.AddStringUnsafe(s)
+		g.AddString(s)
+		if !f.TestStringUnsafe(s) || !f.TestString(s) {
+			t.Errorf("%q should be in.", s)
+		}
+	}
+	if !f.Equal(g) {
+		t.Error("AddStringUnsafe should set the same bits as AddString")
+	}
+	if f.TestStringUnsafe("absent") {
+		t.Errorf("%q should not be in.", "absent")
+	}
+}
 
-	// copy here instead of New
-	g := f.Copy()
-	n2 := []byte("g")
-	g.Add(n2)
+func TestTestConcurrentAdd(t *testing.T) {
+	const n = 2000
+	f := NewWithEstimates(n, 0.01)
+	added := make(chan int, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			f.AddString(fmt.Sprint(i))
+			added <- i
+		}
+		close(added)
+	}()
+	for i := range added {
+		// An Add that has returned must be visible to every later Test.
+		if !f.TestString(fmt.Sprint(i)) {
+			t.Fatalf("%d was added but Test returned false", i)
+		}
+		// Probing the next key races with its Add; either answer is fine,
+		// but a positive answer must stick.
+		next := fmt.Sprint(i + 1)
+		if f.TestString(next) && !f.TestString(next) {
+			t.Fatalf("Test of %s flipped from true to false", next)
+		}
+	}
+}
 
-	n1fb := f.Test(n1)
-	if !n1fb {
-		t.Errorf("The value doesn't exist in original after making a copy")
+func TestCopyUnalignedM(t *testing.T) {
+	for _, m := range []uint{1, 63, 65, 100, 129} {
+		f := New(m, 3)
+		for i := 0; i < 50; i++ {
+			f.AddString(fmt.Sprintf("item%d", i))
+		}
+		// Make sure the last bit is covered as well.
+		f.bitset().Set(m - 1)
+		g := f.Copy()
+		if !f.Equal(g) {
+			t.Errorf("m=%d: copy should be equal to the original", m)
+		}
+		if g.BitSet().Count() != f.BitSet().Count() {
+			t.Errorf("m=%d: copy has %d bits set, want %d", m, g.BitSet().Count(), f.BitSet().Count())
+		}
 	}
+}
 
-	n1gb := g.Test(n1)
-	if !n1gb {
-		t.Errorf("The value doesn't exist in the copy")
+func TestClearAllSyncConcurrent(t *testing.T) {
+	f := New(1000, 4)
+	g := New(1000, 4)
+	for i := 0; i < 100; i++ {
+		g.AddString(fmt.Sprintf("g%d", i))
 	}
 
-	n2fb := f.Test(n2)
-	if n2fb {
-		t.Errorf("The value exists in the original, it should only exist in copy")
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			f.AddString(fmt.Sprintf("f%d", i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for !stop.Load() {
+			if err := f.Merge(g); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		f.ClearAllSync()
 	}
+	stop.Store(true)
+	wg.Wait()
 
-	n2gb := g.Test(n2)
-	if !n2gb {
-		t.Errorf("The value doesn't exist in copy after Add()")
+	// Once all writers are done, a clear leaves nothing behind.
+	f.ClearAllSync()
+	if c := f.bitset().Count(); c != 0 {
+		t.Errorf("%d bits still set after ClearAllSync", c)
+	}
+	// Adds that start after the clear returns are always visible.
+	f.AddString("after")
+	if !f.TestString("after") {
+		t.Error("value added after ClearAllSync is missing")
 	}
 }
 
@@ -617,6 +2999,198 @@ func TestTestLocations(t *testing.T) {
 	}
 }
 
+func TestAddLocations(t *testing.T) {
+	f := NewWithEstimates(1000, 0.001)
+	g := New(f.Cap(), f.K())
+	n1 := []byte("Love")
+	f.AddLocations(Locations(n1, f.K()))
+	g.Add(n1)
+	if !f.Test(n1) {
+		t.Errorf("%v should be in.", n1)
+	}
+	if !f.Equal(g) {
+		t.Error("AddLocations should set the same bits as Add")
+	}
+	if f.Test([]byte("is")) {
+		t.Errorf("%v should not be in.", "is")
+	}
+}
+
+func TestBaseHashes(t *testing.T) {
+	for _, salt := range [][]byte{nil, []byte("salt")} {
+		f := NewWithSalt(1000, 5, salt)
+		g := NewWithSalt(1000, 5, salt)
+		for i := 0; i < 50; i++ {
+			x := []byte(fmt.Sprintf("item%d", i))
+			f.AddHash(BaseHashes(x))
+			g.Add(x)
+			if !g.TestHash(BaseHashes(x)) {
+				t.Fatalf("salt %q: TestHash(BaseHashes(%s)) = false after Add", salt, x)
+			}
+		}
+		if !f.Equal(g) {
+			t.Errorf("salt %q: AddHash(BaseHashes(x)) should set the same bits as Add(x)", salt)
+		}
+	}
+	var d Digest128
+	h1, h2, h3, h4 := d.Sum256([]byte("x"))
+	if BaseHashes([]byte("x")) != [4]uint64{h1, h2, h3, h4} {
+		t.Error("BaseHashes should return the murmur3 Sum256 values")
+	}
+}
+
+func TestTestLocationsBatch(t *testing.T) {
+	const k = 4
+	filters := []*BloomFilter{New(1000, k), New(4096, k), New(100003, k)}
+	var keys [][]uint64
+	var want []bool
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		keys = append(keys, Locations(key, k))
+		want = append(want, i%2 == 0)
+		if i%2 == 0 {
+			for _, f := range filters {
+				f.AddLocations(Locations(key, k))
+			}
+		}
+	}
+	for _, f := range filters {
+		got := f.TestLocationsBatch(keys)
+		for i := range keys {
+			if got[i] != f.TestLocations(keys[i]) {
+				t.Fatalf("m=%d: key %d: batch result differs from TestLocations", f.Cap(), i)
+			}
+			if want[i] && !got[i] {
+				t.Errorf("m=%d: key %d should be in", f.Cap(), i)
+			}
+		}
+	}
+	if got := New(1000, k).TestLocationsBatch(keys); slices.Contains(got, true) {
+		t.Error("an empty filter should contain no key")
+	}
+	if got := filters[0].TestLocationsBatch(nil); len(got) != 0 {
+		t.Errorf("TestLocationsBatch(nil) = %v, want empty", got)
+	}
+}
+
+func TestFilterInterface(t *testing.T) {
+	for name, newFilter := range map[string]func() Filter{
+		"BloomFilter": func() Filter { return New(1000, 4) },
+	} {
+		f := newFilter()
+		if n := f.AddN([]byte("one")); n != 1 {
+			t.Errorf("%s: AddN returned %d, want 1", name, n)
+		}
+		if !f.Test([]byte("one")) || f.Test([]byte("two")) {
+			t.Errorf("%s: wrong membership", name)
+		}
+		if f.Cap() != 1000 || f.K() != 4 || f.Count() == 0 || f.Count() > 4 {
+			t.Errorf("%s: Cap() = %d, K() = %d, Count() = %d", name, f.Cap(), f.K(), f.Count())
+		}
+
+		var buf bytes.Buffer
+		if _, err := f.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		g := newFilter()
+		if _, err := g.ReadFrom(&buf); err != nil {
+			t.Fatal(err)
+		}
+		data, err := g.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := newFilter()
+		if err := h.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !h.Test([]byte("one")) || h.Count() != f.Count() {
+			t.Errorf("%s: serialization round trip lost content", name)
+		}
+	}
+}
+
+func TestCanonicalBytes(t *testing.T) {
+	f := New(100, 3)
+	for _, i := range []uint{0, 63, 64, 99} {
+		f.bitset().Set(i)
+	}
+	// Pinned: this output must never change.
+	const golden = "0000000000000064" + "0000000000000003" + // m, k
+		"0000000000000064" + "0000000000000002" + // Size, number of words
+		"8000000000000001" + "0000000800000001" // Words
+	if got := hex.EncodeToString(f.CanonicalBytes()); got != golden {
+		t.Errorf("CanonicalBytes() = %s, want %s", got, golden)
+	}
+	salted := FromWithM(wordsOf(f), 100, 3)
+	salted.setSalt([]byte("ab"))
+	const saltedGolden = "0000000000000064" + "8000000000000003" + // m, k with the salt flag
+		"0000000000000002" + "6162" + // Salt length, salt
+		"0000000000000064" + "0000000000000002" +
+		"8000000000000001" + "0000000800000001"
+	if got := hex.EncodeToString(salted.CanonicalBytes()); got != saltedGolden {
+		t.Errorf("salted CanonicalBytes() = %s, want %s", got, saltedGolden)
+	}
+
+	// Bits past m do not show.
+	dirty := FromWithM([]int64{wordsOf(f)[0], wordsOf(f)[1] | -1<<36}, 100, 3)
+	if !bytes.Equal(dirty.CanonicalBytes(), f.CanonicalBytes()) {
+		t.Error("bits past m should not change the canonical bytes")
+	}
+
+	var g BloomFilter
+	if err := g.UnmarshalBinary(salted.CanonicalBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Equal(salted) {
+		t.Error("canonical bytes should read back with UnmarshalBinary")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	f := New(1000, 4)
+	g := New(1000, 4)
+	if f.Fingerprint() != g.Fingerprint() {
+		t.Error("empty filters with the same parameters should share a fingerprint")
+	}
+	for i := 0; i < 50; i++ {
+		f.AddString(fmt.Sprint(i))
+	}
+	for i := 49; i >= 0; i-- {
+		g.AddString(fmt.Sprint(i))
+	}
+	if !f.Equal(g) || f.Fingerprint() != g.Fingerprint() {
+		t.Error("equal filters should share a fingerprint")
+	}
+	if f.Copy().Fingerprint() != f.Fingerprint() {
+		t.Error("a copy should share the fingerprint")
+	}
+
+	fp := f.Fingerprint()
+	for name, other := range map[string]*BloomFilter{
+		"extra item": g.Copy().AddString("extra"),
+		"m":          FromWithM(wordsOf(f), 999, 4),
+		"k":          FromWithM(wordsOf(f), 1000, 5),
+		"empty":      New(1000, 4),
+	} {
+		if other.Fingerprint() == fp {
+			t.Errorf("%s: different filters share a fingerprint", name)
+		}
+	}
+	if NewWithSalt(1000, 4, []byte("s")).Fingerprint() == New(1000, 4).Fingerprint() {
+		t.Error("filters with different salts share a fingerprint")
+	}
+}
+
+// wordsOf returns a copy of the words of f.
+func wordsOf(f *BloomFilter) []int64 {
+	words := make([]int64, f.NumWords())
+	for i := range words {
+		words[i] = int64(f.WordAt(i))
+	}
+	return words
+}
+
 func TestApproximatedSize(t *testing.T) {
 	f := NewWithEstimates(1000, 0.001)
 	f.Add([]byte("Love"))
@@ -629,6 +3203,70 @@ func TestApproximatedSize(t *testing.T) {
 	}
 }
 
+func TestOptimalMForCurrent(t *testing.T) {
+	f := New(100000, 5)
+	for i := 0; i < 2000; i++ {
+		f.AddString(fmt.Sprintf("key%d", i))
+	}
+	for _, target := range []float64{0.1, 0.01, 0.001} {
+		m := f.OptimalMForCurrent(target)
+		n := float64(f.ApproximatedSize())
+		_, k := EstimateParameters(uint(n), target)
+		fp := math.Pow(1-math.Exp(-float64(k)*n/float64(m)), float64(k))
+		if fp > target*1.1 || fp < target*0.8 {
+			t.Errorf("target %v: m=%d, k=%d gives fp %v", target, m, k, fp)
+		}
+	}
+	if New(1000, 4).OptimalMForCurrent(0.01) == 0 {
+		t.Error("empty filter should still report a usable m")
+	}
+}
+
+func TestStringSummary(t *testing.T) {
+	f := New(1000, 4)
+	f.AddString("Love")
+	f.AddString("is")
+	got := f.String()
+	want := "BloomFilter{m: 1000, k: 4, set: 8, fill: 0.0080, fp: 4.1e-09, n: 2}"
+	if got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if s := fmt.Sprintf("%v", f); s != got {
+		t.Errorf("%%v should use String(), got %q", s)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	f := NewWithEstimates(1000, 0.01)
+	for i := 0; i < 500; i++ {
+		f.AddString(fmt.Sprintf("key%d", i))
+	}
+	h := f.Health()
+	if h.BitsSet != f.bitset().Count() {
+		t.Errorf("BitsSet %d != Count() %d", h.BitsSet, f.bitset().Count())
+	}
+	if h.FillRatio != float64(h.BitsSet)/float64(f.Cap()) {
+		t.Errorf("FillRatio %v is inconsistent with BitsSet", h.FillRatio)
+	}
+	if h.EstimatedFP != math.Pow(h.FillRatio, float64(f.K())) {
+		t.Errorf("EstimatedFP %v is inconsistent with FillRatio", h.EstimatedFP)
+	}
+	if h.EstimatedSize != f.ApproximatedSize() {
+		t.Errorf("EstimatedSize %d != ApproximatedSize() %d", h.EstimatedSize, f.ApproximatedSize())
+	}
+	if h.Saturated {
+		t.Error("half-full filter should not be saturated")
+	}
+
+	g := New(8, 1)
+	for i := uint(0); i < g.Cap(); i++ {
+		g.bitset().Set(i)
+	}
+	if h := g.Health(); !h.Saturated || h.FillRatio != 1 || h.EstimatedFP != 1 {
+		t.Errorf("full filter should be saturated, got %+v", h)
+	}
+}
+
 func TestFPP(t *testing.T) {
 	f := NewWithEstimates(1000, 0.001)
 	for i := uint32(0); i < 1000; i++ {
@@ -671,10 +3309,10 @@ func TestEncodeDecodeBinary(t *testing.T) {
 	if g.k != f.k {
 		t.Error("invalid k value")
 	}
-	if g.b == nil {
+	if g.bitset() == nil {
 		t.Fatal("bitset is nil")
 	}
-	if !g.b.Equal(f.b) {
+	if !g.bitset().Equal(f.bitset()) {
 		t.Error("bitsets are not equal")
 	}
 	if !g.Test([]byte("three")) {
@@ -688,6 +3326,43 @@ func TestEncodeDecodeBinary(t *testing.T) {
 	}
 }
 
+func TestToByteSlice(t *testing.T) {
+	f := New(20, 1)
+	f.bitset().Set(0)
+	f.bitset().Set(9)
+	f.bitset().Set(19)
+	got := f.ToByteSlice()
+	want := []byte{0x01, 0x02, 0x08}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ToByteSlice() = %x, want %x", got, want)
+	}
+
+	// Bits past m, here from dirty words, are not exported.
+	dirty := FromWithM([]int64{-1}, 20, 1)
+	if got, want := dirty.ToByteSlice(), []byte{0xff, 0xff, 0x0f}; !bytes.Equal(got, want) {
+		t.Errorf("ToByteSlice() = %x with bits past m, want %x", got, want)
+	}
+}
+
+func TestToFromByteSlice(t *testing.T) {
+	for _, m := range []uint{1, 7, 64, 100, 1000} {
+		f := New(m, 3)
+		for i := 0; i < 50; i++ {
+			f.AddString(fmt.Sprintf("key%d", i))
+		}
+		g := FromByteSlice(f.ToByteSlice(), f.Cap(), f.K())
+		if !f.Equal(g) {
+			t.Errorf("m=%d: filter does not survive a byte slice round trip", m)
+		}
+		if g.IsDirty() {
+			t.Errorf("m=%d: a filter loaded from a byte slice should not be dirty", m)
+		}
+		if g.IsEmpty() {
+			t.Errorf("m=%d: a filter loaded from a byte slice should not be empty", m)
+		}
+	}
+}
+
 func BenchmarkAdd(b *testing.B) {
 	f := NewWithEstimates(uint(b.N), 0.0001)
 
@@ -725,6 +3400,141 @@ func BenchmarkTest(b *testing.B) {
 	}
 }
 
+func BenchmarkAddK1(b *testing.B) {
+	f := New(1<<20, 1)
+	key := make([]byte, 16)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint32(key, uint32(i))
+		f.Add(key)
+	}
+}
+
+func BenchmarkTestK1(b *testing.B) {
+	f := New(1<<20, 1)
+	key := make([]byte, 16)
+	for i := 0; i < 1<<16; i++ {
+		binary.BigEndian.PutUint32(key, uint32(i))
+		f.Add(key)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint32(key, uint32(i))
+		f.Test(key)
+	}
+}
+
+func duplicateHeavyItems() [][]byte {
+	items := make([][]byte, 10000)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("%0128d", i%100))
+	}
+	return items
+}
+
+func BenchmarkAddBatchDuplicates(b *testing.B) {
+	f := New(1<<20, 4)
+	items := duplicateHeavyItems()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.AddBatch(items)
+	}
+}
+
+func BenchmarkAddAllDedupedDuplicates(b *testing.B) {
+	f := New(1<<20, 4)
+	items := duplicateHeavyItems()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.AddAllDeduped(items)
+	}
+}
+
+func benchmarkStrings() []string {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%0256d", i)
+	}
+	return keys
+}
+
+func BenchmarkAddString(b *testing.B) {
+	f := New(1<<20, 4)
+	keys := benchmarkStrings()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.AddString(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkAddStringUnsafe(b *testing.B) {
+	f := New(1<<20, 4)
+	keys := benchmarkStrings()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.AddStringUnsafe(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkAddUint64(b *testing.B) {
+	f := New(1<<20, 4)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.AddUint64(uint64(i))
+	}
+}
+
+func BenchmarkAddUint64Encoded(b *testing.B) {
+	f := New(1<<20, 4)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Add(binary.BigEndian.AppendUint64(make([]byte, 0, 8), uint64(i)))
+	}
+}
+
+func BenchmarkTestString(b *testing.B) {
+	f := New(1<<20, 4)
+	keys := benchmarkStrings()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.TestString(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkTestStringUnsafe(b *testing.B) {
+	f := New(1<<20, 4)
+	keys := benchmarkStrings()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.TestStringUnsafe(keys[i%len(keys)])
+	}
+}
+
+func benchmarkTestM(b *testing.B, m uint) {
+	f := New(m, 4)
+	key := make([]byte, 16)
+	for i := 0; i < 1<<16; i++ {
+		binary.BigEndian.PutUint32(key, uint32(i))
+		f.Add(key)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint32(key, uint32(i))
+		f.Test(key)
+	}
+}
+
+func BenchmarkTestModulo(b *testing.B) { benchmarkTestM(b, 1<<20-1) }
+func BenchmarkTestPow2(b *testing.B)   { benchmarkTestM(b, 1<<20) }
+
 func BenchmarkConcurrent(b *testing.B) {
 	gmp := runtime.GOMAXPROCS(2)
 	defer runtime.GOMAXPROCS(gmp)
@@ -860,3 +3670,60 @@ func TestConcurrentAddAndTestThroughput(t *testing.T) {
 		t.Errorf("Total keys tested: %d, Throughput: %.5f keys/sec", totalKeys, throughput)
 	}
 }
+
+func TestStrictBounds(t *testing.T) {
+	dirty := func() *BloomFilter { return FromWithM([]int64{-1, -1}, 100, 3) }
+	if n := dirty().Count(); n != 128 {
+		t.Fatalf("dirty filter has %d bits set, want 128", n)
+	}
+	f := dirty().StrictBounds()
+	if n := f.Count(); n != 100 {
+		t.Errorf("strict filter has %d bits set, want 100", n)
+	}
+	full := New(100, 3)
+	for i := uint(0); i < 100; i++ {
+		full.bitset().Set(i)
+	}
+	if !f.Equal(full) || f.Fingerprint() != full.Fingerprint() {
+		t.Error("strict filter should equal one built with Set")
+	}
+	c := f.Copy()
+	if err := c.Merge(dirty()); err != nil || c.Count() != 100 {
+		t.Error("copy should keep strict bounds")
+	}
+
+	var buf bytes.Buffer
+	if _, err := dirty().WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	jsonData, err := json.Marshal(dirty())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, load := range map[string]func(g *BloomFilter) error{
+		"Merge":       func(g *BloomFilter) error { return g.Merge(dirty()) },
+		"MergeUnsafe": func(g *BloomFilter) error { return g.MergeUnsafe(dirty()) },
+		"UnionInto":   func(g *BloomFilter) error { return UnionInto(dirty(), New(100, 3), g) },
+		"ReadFrom": func(g *BloomFilter) error {
+			_, err := g.ReadFrom(bytes.NewReader(data))
+			return err
+		},
+		"UnmarshalBinary": func(g *BloomFilter) error { return g.UnmarshalBinary(data) },
+		"UnmarshalJSON":   func(g *BloomFilter) error { return json.Unmarshal(jsonData, g) },
+		"MergeFromReaders": func(g *BloomFilter) error {
+			return MergeFromReaders(g, bytes.NewReader(data))
+		},
+	} {
+		g := New(100, 3).StrictBounds()
+		if err := load(g); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if n := g.Count(); n != 100 {
+			t.Errorf("%s: strict filter has %d bits set, want 100", name, n)
+		}
+		if w := g.WordAt(1); w>>36 != 0 {
+			t.Errorf("%s: bits past m are set in word %#x", name, w)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Package bloomtest provides utilities for testing code built on atomic
+// Bloom filters.
+package bloomtest
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	bloom "github.com/ericvolp12/atomic-bloom"
+)
+
+// StressConcurrent hammers f from goroutines goroutines, each running
+// opsPerG operations mixing Add, Test and TestAndAdd on keys of its own,
+// and checks the guarantees a Bloom filter gives under concurrency: an item
+// is present as soon as its Add returns, stays present, and TestAndAdd of
+// an item already added reports it present. It returns an error describing
+// every goroutine that saw one of these broken, or nil.
+//
+// It adds about opsPerG/2 items per goroutine to f, so run it on a filter
+// configured like the one under test rather than on one holding real data.
+// Running it with the race detector also checks for data races.
+func StressConcurrent(f *bloom.BloomFilter, goroutines, opsPerG int) error {
+	if goroutines < 1 {
+		return fmt.Errorf("invalid goroutines value: %d", goroutines)
+	}
+	if opsPerG < 0 {
+		return fmt.Errorf("invalid opsPerG value: %d", opsPerG)
+	}
+	errs := make([]error, goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := stress(f, g, opsPerG); err != nil {
+				errs[g] = fmt.Errorf("goroutine %d: %w", g, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// stress runs the operations of goroutine g and returns the first
+// inconsistency it sees.
+func stress(f *bloom.BloomFilter, g, ops int) error {
+	key := func(i int) []byte {
+		return []byte("bloomtest-" + strconv.Itoa(g) + "-" + strconv.Itoa(i))
+	}
+	for i := 0; i < ops; i++ {
+		switch i % 4 {
+		case 0:
+			f.Add(key(i))
+			if !f.Test(key(i)) {
+				return fmt.Errorf("op %d: %s absent right after Add", i, key(i))
+			}
+		case 1:
+			f.TestAndAdd(key(i))
+			if !f.Test(key(i)) {
+				return fmt.Errorf("op %d: %s absent right after TestAndAdd", i, key(i))
+			}
+		case 2:
+			// Adds only ever set bits, so an earlier item must survive
+			// the adds of every goroutine since.
+			if !f.Test(key(i - 2)) {
+				return fmt.Errorf("op %d: %s absent after later adds", i, key(i-2))
+			}
+		case 3:
+			if !f.TestAndAdd(key(i - 2)) {
+				return fmt.Errorf("op %d: TestAndAdd reports %s absent after it was added", i, key(i-2))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package bloomtest
+
+import (
+	"testing"
+
+	bloom "github.com/ericvolp12/atomic-bloom"
+)
+
+func TestStressConcurrent(t *testing.T) {
+	for name, f := range map[string]*bloom.BloomFilter{
+		"sized":  bloom.NewWithEstimates(20000, 0.01),
+		"salted": bloom.NewWithSalt(100000, 5, []byte("salt")),
+		"tiny":   bloom.New(64, 3), // Saturates almost at once
+	} {
+		if err := StressConcurrent(f, 8, 2000); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		// Three operations in four add, one of them an item again.
+		if want := uint64(8 * 1500); f.TotalAdds() != want {
+			t.Errorf("%s: TotalAdds() = %d, want %d", name, f.TotalAdds(), want)
+		}
+	}
+}
+
+func TestStressConcurrentInvalid(t *testing.T) {
+	f := bloom.New(1000, 3)
+	if err := StressConcurrent(f, 0, 10); err == nil {
+		t.Error("zero goroutines should be rejected")
+	}
+	if err := StressConcurrent(f, 2, -1); err == nil {
+		t.Error("a negative number of operations should be rejected")
+	}
+	if err := StressConcurrent(f, 2, 0); err != nil {
+		t.Errorf("no operations: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package bloom
+
+import (
+	"math"
+	"sync"
+)
+
+// boundedStages is the number of sub-filters of a BoundedFilter.
+const boundedStages = 4
+
+// A BoundedFilter is a Bloom filter for an unbounded stream of items that
+// never grows past a fixed memory budget. Items go into the newest of a few
+// equally sized sub-filters, or stages; once it holds as many items as its
+// false positive target allows, a new stage is started and, if all stages
+// are in use, the oldest one is dropped along with its items. It answers
+// "was this item seen recently?": items older than the last few stages are
+// forgotten. It is safe for concurrent use.
+type BoundedFilter struct {
+	mu       sync.RWMutex
+	stages   []*BloomFilter // Oldest first; the last one receives the adds
+	m, k     uint           // Parameters of every stage
+	capacity uint64         // Adds after which a stage is full
+}
+
+// NewBounded creates a BoundedFilter using at most maxBytes bytes for its
+// bits, split between its stages, whose false positive rate stays below
+// targetFP however many items are added. Each stage gets targetFP divided
+// by the number of stages, since an item is tested against all of them.
+// Stages have at least 64 bits, so a tiny maxBytes is rounded up to 32
+// bytes.
+func NewBounded(maxBytes uint, targetFP float64) *BoundedFilter {
+	// Whole words per stage, so that the allocation matches the budget.
+	m := max(1, maxBytes/8/boundedStages) * 64
+	p := targetFP / boundedStages
+	n := max(1, uint(float64(m)*math.Pow(math.Log(2), 2)/-math.Log(p)))
+	k := BestKForM(m, n)
+	return &BoundedFilter{
+		stages:   []*BloomFilter{New(m, k)},
+		m:        m,
+		k:        k,
+		capacity: uint64(n),
+	}
+}
+
+// Add adds data to the newest stage, starting a new stage first if it is
+// full.
+func (b *BoundedFilter) Add(data []byte) {
+	h := baseHashes(data)
+	b.mu.RLock()
+	cur := b.stages[len(b.stages)-1]
+	full := cur.TotalAdds() >= b.capacity
+	if !full {
+		cur.AddHash(h)
+	}
+	b.mu.RUnlock()
+	if !full {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Another Add may have rotated the stages while the lock was released.
+	if last := b.stages[len(b.stages)-1]; last.TotalAdds() >= b.capacity {
+		if len(b.stages) == boundedStages {
+			b.stages[0] = nil // Let the oldest stage be collected
+			b.stages = b.stages[1:]
+		}
+		b.stages = append(b.stages, New(b.m, b.k))
+	}
+	b.stages[len(b.stages)-1].AddHash(h)
+}
+
+// Test returns true if data is *probably* in one of the stages, false
+// otherwise. The data is hashed once for all the stages.
+func (b *BoundedFilter) Test(data []byte) bool {
+	h := baseHashes(data)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for i := len(b.stages) - 1; i >= 0; i-- {
+		if b.stages[i].TestHash(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// SizeBytes returns the number of bytes held by the stages' bits, which
+// never exceeds the budget given to NewBounded, once rounded up to 32
+// bytes.
+func (b *BoundedFilter) SizeBytes() uint {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return uint(len(b.stages)) * (b.m / 8) // m is a multiple of 64
+}
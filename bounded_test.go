@@ -0,0 +1,78 @@
+package bloom
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestBounded(t *testing.T) {
+	const maxBytes = 4096
+	b := NewBounded(maxBytes, 0.01)
+	for i := 0; i < 100000; i++ {
+		b.Add([]byte(fmt.Sprint(i)))
+		if size := b.SizeBytes(); size > maxBytes {
+			t.Fatalf("after %d adds, SizeBytes() = %d, want at most %d", i+1, size, maxBytes)
+		}
+	}
+	if len(b.stages) != boundedStages {
+		t.Errorf("%d stages in use, want %d", len(b.stages), boundedStages)
+	}
+	// The newest stage is never dropped, so its capacity of recent items
+	// is always present.
+	for i := 100000 - int(b.capacity); i < 100000; i++ {
+		if !b.Test([]byte(fmt.Sprint(i))) {
+			t.Fatalf("recent item %d is missing", i)
+		}
+	}
+	// Items never added, like the oldest ones, are mostly absent.
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if b.Test([]byte(fmt.Sprint("absent", i))) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / 10000; rate > 0.02 {
+		t.Errorf("false positive rate %.4f, want about 0.01 at most", rate)
+	}
+	if b.Test([]byte("0")) && b.Test([]byte("1")) && b.Test([]byte("2")) {
+		t.Error("the oldest items should have been forgotten")
+	}
+}
+
+func TestBoundedTiny(t *testing.T) {
+	b := NewBounded(0, 0.01)
+	b.Add([]byte("x"))
+	if !b.Test([]byte("x")) || b.SizeBytes() != 8 {
+		t.Errorf("tiny filter: Test = %v, SizeBytes() = %d", b.Test([]byte("x")), b.SizeBytes())
+	}
+}
+
+func TestBoundedConcurrent(t *testing.T) {
+	// The stages are large enough that no item is dropped, but the adds
+	// still start new stages.
+	const maxBytes = 1 << 16
+	b := NewBounded(maxBytes, 0.01)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				key := []byte(fmt.Sprint(g, "-", i))
+				b.Add(key)
+				if !b.Test(key) {
+					t.Errorf("%s is missing right after Add", key)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if len(b.stages) < 2 {
+		t.Errorf("%d stages in use, want several", len(b.stages))
+	}
+	if size := b.SizeBytes(); size > maxBytes {
+		t.Errorf("SizeBytes() = %d, want at most %d", size, maxBytes)
+	}
+}
@@ -0,0 +1,59 @@
+package bloom
+
+import (
+	"math"
+	"slices"
+)
+
+// DistributionReport summarizes how a keyset spreads over the bits of a
+// filter with given _m_ and _k_. It is returned by AnalyzeHashDistribution.
+type DistributionReport struct {
+	Probes           uint    // Total number of probes, len(keys) * k
+	ChiSquared       float64 // Chi-squared statistic against a uniform spread
+	DegreesOfFreedom uint    // m - 1, for looking up the chi-squared critical value
+	MeanLoad         float64 // Expected probes per bit under a uniform spread
+	MaxLoad          uint    // Largest number of probes landing on a single bit
+	EmptyBits        uint    // Bits no probe landed on
+	SelfCollisions   uint    // Keys whose own k probes hit fewer than k distinct bits
+}
+
+// AnalyzeHashDistribution hashes every key as a filter with _m_ bits and _k_
+// hashing functions would, and reports how evenly the probes spread over the
+// bits. Use it to check a real keyspace against the hashing before choosing
+// parameters: a ChiSquared far above DegreesOfFreedom, or a MaxLoad far
+// above MeanLoad, means the keys do not spread uniformly (for instance
+// because of duplicates).
+func AnalyzeHashDistribution(keys [][]byte, m, k uint) DistributionReport {
+	f := New(m, k)
+	loads := make([]uint, f.m)
+	seen := make([]uint, 0, f.k)
+	var r DistributionReport
+	for _, key := range keys {
+		h := baseHashes(key)
+		seen = seen[:0]
+		for i := uint(0); i < f.k; i++ {
+			l := f.location(h, i)
+			loads[l]++
+			if !slices.Contains(seen, l) {
+				seen = append(seen, l)
+			}
+		}
+		if uint(len(seen)) < f.k {
+			r.SelfCollisions++
+		}
+	}
+
+	r.Probes = uint(len(keys)) * f.k
+	r.DegreesOfFreedom = f.m - 1
+	r.MeanLoad = float64(r.Probes) / float64(f.m)
+	for _, load := range loads {
+		if load == 0 {
+			r.EmptyBits++
+		}
+		r.MaxLoad = max(r.MaxLoad, load)
+		if r.MeanLoad > 0 {
+			r.ChiSquared += math.Pow(float64(load)-r.MeanLoad, 2) / r.MeanLoad
+		}
+	}
+	return r
+}
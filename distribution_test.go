@@ -0,0 +1,45 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestAnalyzeHashDistribution(t *testing.T) {
+	const m, k, n = 64, 3, 10000
+	uniform := make([][]byte, n)
+	skewed := make([][]byte, n)
+	for i := range uniform {
+		uniform[i] = make([]byte, 4)
+		binary.BigEndian.PutUint32(uniform[i], uint32(i))
+		skewed[i] = make([]byte, 4)
+		binary.BigEndian.PutUint32(skewed[i], uint32(i%10))
+	}
+
+	u := AnalyzeHashDistribution(uniform, m, k)
+	s := AnalyzeHashDistribution(skewed, m, k)
+	if u.Probes != n*k || s.Probes != n*k {
+		t.Errorf("expected %d probes, got %d and %d", n*k, u.Probes, s.Probes)
+	}
+	if u.DegreesOfFreedom != m-1 || u.MeanLoad != float64(n*k)/m {
+		t.Errorf("unexpected degrees of freedom or mean load: %+v", u)
+	}
+	// 99.9th percentile of chi-squared with 63 degrees of freedom is ~103.4.
+	if u.ChiSquared > 103.4 {
+		t.Errorf("uniform keyset should pass the chi-squared test: %+v", u)
+	}
+	if u.EmptyBits != 0 {
+		t.Errorf("uniform keyset should hit every bit: %+v", u)
+	}
+	if s.ChiSquared < 10*u.ChiSquared || s.MaxLoad < 2*u.MaxLoad {
+		t.Errorf("skewed keyset should stand out: uniform %+v, skewed %+v", u, s)
+	}
+	if s.EmptyBits < m-10*k {
+		t.Errorf("10 distinct keys should leave most bits empty: %+v", s)
+	}
+
+	c := AnalyzeHashDistribution(uniform[:1000], 2, 8)
+	if c.SelfCollisions != 1000 {
+		t.Errorf("with k > m every key collides with itself, got %d", c.SelfCollisions)
+	}
+}
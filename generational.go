@@ -0,0 +1,121 @@
+package bloom
+
+import "sync"
+
+// A GenerationalFilter is a Bloom filter whose entries expire. Every add is
+// tagged with a generation, such as a time bucket, and lands in one of a
+// small ring of sub-filters, one per generation. Since a Bloom filter cannot
+// record a generation per bit, expiring a generation clears its whole
+// sub-filter. Generations are compared as plain integers, so they must not
+// wrap around. It is safe for concurrent use.
+type GenerationalFilter struct {
+	mu      sync.RWMutex
+	slots   []generation
+	minLive uint32 // Generations below this have been expired
+}
+
+// generation is a slot of the ring: the sub-filter holding the adds of gen,
+// if live.
+type generation struct {
+	gen  uint32
+	live bool
+	f    *BloomFilter
+}
+
+// NewGenerational creates a GenerationalFilter keeping the _n_ most recent
+// generations, each in a sub-filter with _m_ bits and _k_ hashing
+// functions. An _n_ below one is treated as one.
+func NewGenerational(m uint, k uint, n int) *GenerationalFilter {
+	if n < 1 {
+		n = 1
+	}
+	g := &GenerationalFilter{slots: make([]generation, n)}
+	for i := range g.slots {
+		g.slots[i].f = New(m, k)
+	}
+	return g
+}
+
+// AddWithGeneration adds data to the sub-filter of generation gen. A
+// generation newer than any seen so far expires every generation that no
+// longer fits in the ring with it, so that the ring always holds the newest
+// generations seen. Returns false, without adding, if gen has been expired,
+// either by ExpireBefore or by newer generations.
+func (g *GenerationalFilter) AddWithGeneration(data []byte, gen uint32) bool {
+	n := uint32(len(g.slots))
+	slot := int(gen % n)
+
+	g.mu.RLock()
+	s := g.slots[slot]
+	if s.live && s.gen == gen {
+		s.f.Add(data)
+		g.mu.RUnlock()
+		return true
+	}
+	g.mu.RUnlock()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s = g.slots[slot]
+	if gen < g.minLive || (s.live && s.gen > gen) {
+		return false
+	}
+	if gen >= n {
+		g.expireBefore(gen - n + 1)
+	}
+	s = g.slots[slot]
+	if !s.live || s.gen != gen {
+		s.f.ClearAll()
+		g.slots[slot] = generation{gen: gen, live: true, f: s.f}
+	}
+	s.f.Add(data)
+	return true
+}
+
+// Test returns true if data is *probably* in a live generation, false
+// otherwise. The data is hashed once for all the sub-filters.
+func (g *GenerationalFilter) Test(data []byte) bool {
+	h := baseHashes(data)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, s := range g.slots {
+		if s.live && s.f.TestHash(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpireBefore drops every generation older than gen, clearing their
+// sub-filters, and rejects later adds to them.
+func (g *GenerationalFilter) ExpireBefore(gen uint32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expireBefore(gen)
+}
+
+// expireBefore is ExpireBefore with g.mu held.
+func (g *GenerationalFilter) expireBefore(gen uint32) {
+	if gen > g.minLive {
+		g.minLive = gen
+	}
+	for i, s := range g.slots {
+		if s.live && s.gen < gen {
+			s.f.ClearAll()
+			g.slots[i].live = false
+		}
+	}
+}
+
+// Generations returns the live generations, in no particular order.
+func (g *GenerationalFilter) Generations() []uint32 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var gens []uint32
+	for _, s := range g.slots {
+		if s.live {
+			gens = append(gens, s.gen)
+		}
+	}
+	return gens
+}
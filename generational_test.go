@@ -0,0 +1,120 @@
+package bloom
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestGenerationalExpiry(t *testing.T) {
+	g := NewGenerational(1000, 4, 3)
+	for gen, key := range []string{"a", "b", "c"} {
+		if !g.AddWithGeneration([]byte(key), uint32(gen)) {
+			t.Fatalf("adding %q to generation %d failed", key, gen)
+		}
+	}
+	check := func(present, absent string) {
+		t.Helper()
+		for _, key := range present {
+			if !g.Test([]byte{byte(key)}) {
+				t.Errorf("%q should be present", key)
+			}
+		}
+		for _, key := range absent {
+			if g.Test([]byte{byte(key)}) {
+				t.Errorf("%q should have expired", key)
+			}
+		}
+	}
+	check("abc", "")
+
+	g.ExpireBefore(1)
+	check("bc", "a")
+	if g.AddWithGeneration([]byte("x"), 0) {
+		t.Error("adding to an expired generation should fail")
+	}
+
+	// Generation 3 reuses the slot freed by generation 0.
+	g.AddWithGeneration([]byte("d"), 3)
+	check("bcd", "ax")
+	// Generation 4 evicts generation 1, the oldest in the ring.
+	g.AddWithGeneration([]byte("e"), 4)
+	check("cde", "abx")
+	if g.AddWithGeneration([]byte("y"), 1) {
+		t.Error("adding to an evicted generation should fail")
+	}
+	gens := g.Generations()
+	slices.Sort(gens)
+	if !slices.Equal(gens, []uint32{2, 3, 4}) {
+		t.Errorf("live generations %v, want [2 3 4]", gens)
+	}
+
+	g.ExpireBefore(5)
+	check("", "abcdexy")
+	if len(g.Generations()) != 0 {
+		t.Errorf("no generation should be live, got %v", g.Generations())
+	}
+}
+
+func TestGenerationalSkip(t *testing.T) {
+	g := NewGenerational(1000, 4, 3)
+	for gen, key := range []string{"a", "b", "c"} {
+		g.AddWithGeneration([]byte(key), uint32(gen))
+	}
+	// Generation 10 leaves room only for generations 8 and 9 beside it.
+	if !g.AddWithGeneration([]byte("d"), 10) {
+		t.Fatal("adding to generation 10 failed")
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if g.Test([]byte(key)) {
+			t.Errorf("%q should have expired", key)
+		}
+	}
+	if !g.Test([]byte("d")) {
+		t.Error("d should be present")
+	}
+	if gens := g.Generations(); !slices.Equal(gens, []uint32{10}) {
+		t.Errorf("live generations %v, want [10]", gens)
+	}
+	for _, gen := range []uint32{0, 2, 7} {
+		if g.AddWithGeneration([]byte("x"), gen) {
+			t.Errorf("adding to expired generation %d should fail", gen)
+		}
+	}
+	if !g.AddWithGeneration([]byte("e"), 8) || !g.AddWithGeneration([]byte("f"), 9) {
+		t.Error("generations 8 and 9 still fit in the ring")
+	}
+	gens := g.Generations()
+	slices.Sort(gens)
+	if !slices.Equal(gens, []uint32{8, 9, 10}) {
+		t.Errorf("live generations %v, want [8 9 10]", gens)
+	}
+}
+
+func TestGenerationalConcurrent(t *testing.T) {
+	g := NewGenerational(10000, 4, 4)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				gen := uint32(i / 50)
+				if !g.AddWithGeneration([]byte(fmt.Sprint(w, i)), gen) {
+					t.Errorf("adding to generation %d failed", gen)
+					return
+				}
+				g.Test([]byte(fmt.Sprint(w, i)))
+			}
+		}(w)
+	}
+	wg.Wait()
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 200; i++ {
+			if !g.Test([]byte(fmt.Sprint(w, i))) {
+				t.Fatalf("%d %d is missing", w, i)
+			}
+		}
+	}
+}
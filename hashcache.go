@@ -0,0 +1,84 @@
+package bloom
+
+import (
+	"container/list"
+	"sync"
+	"unsafe"
+)
+
+// hashCache is a least-recently-used cache of the base hashes of strings,
+// see NewWithHashCache. It is safe for concurrent use.
+type hashCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element // Values are *hashCacheEntry
+	lru     list.List                // Most recently used first
+}
+
+type hashCacheEntry struct {
+	key string // A view of buf
+	buf []byte // Reused when the entry is evicted, to avoid an allocation per miss
+	h   [4]uint64
+}
+
+func newHashCache(size int) *hashCache {
+	c := &hashCache{size: size, entries: make(map[string]*list.Element, size)}
+	c.lru.Init()
+	return c
+}
+
+// NewWithHashCache creates a new Bloom filter with _m_ bits and _k_ hashing
+// functions whose AddString and TestString remember the hashes of the
+// cacheSize most recently used strings, so that repeated keys are not
+// hashed again. Each entry holds a copy of its key plus about 150 bytes of
+// bookkeeping, and every lookup takes a lock shared by all goroutines using
+// the filter. A miss costs more than hashing, so this pays off only for
+// long keys with a very skewed distribution, where nearly every operation
+// hits: in the benchmarks, with 256-byte keys, a 99% hit rate makes adds
+// about 30% faster, but an 80% hit rate makes them slower. A cacheSize
+// below one is the same as New. Copies and decoded filters have no cache.
+func NewWithHashCache(m uint, k uint, cacheSize int) *BloomFilter {
+	f := New(m, k)
+	if cacheSize > 0 {
+		f.cache = newHashCache(cacheSize)
+	}
+	return f
+}
+
+// hashes returns the base hashes of s, from the cache if possible.
+func (c *hashCache) hashes(s string) [4]uint64 {
+	c.mu.Lock()
+	if e, ok := c.entries[s]; ok {
+		c.lru.MoveToFront(e)
+		h := e.Value.(*hashCacheEntry).h
+		c.mu.Unlock()
+		return h
+	}
+	c.mu.Unlock()
+
+	// Hash outside the lock; a concurrent miss on the same key only
+	// computes the same hashes twice.
+	h := baseHashes(unsafeBytes(s))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[s]; ok {
+		return h
+	}
+	var e *list.Element
+	if c.lru.Len() >= c.size {
+		// Reuse the least recently used entry. Its key is removed from the
+		// map before its buffer is overwritten.
+		e = c.lru.Back()
+		delete(c.entries, e.Value.(*hashCacheEntry).key)
+		c.lru.MoveToFront(e)
+	} else {
+		e = c.lru.PushFront(&hashCacheEntry{})
+	}
+	entry := e.Value.(*hashCacheEntry)
+	// Copy the key so that the cache does not keep a larger string alive.
+	entry.buf = append(entry.buf[:0], s...)
+	entry.key, entry.h = unsafe.String(unsafe.SliceData(entry.buf), len(entry.buf)), h
+	c.entries[entry.key] = e
+	return h
+}
@@ -0,0 +1,90 @@
+package bloom
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestHashCache(t *testing.T) {
+	f := NewWithHashCache(10000, 4, 8)
+	g := New(10000, 4)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint(i % 20)
+		f.AddString(key)
+		g.AddString(key)
+		if !f.TestString(key) {
+			t.Fatalf("%q should be in", key)
+		}
+	}
+	if !f.Equal(g) {
+		t.Error("a cached filter should set the same bits as a plain one")
+	}
+	if f.TestString("absent") != g.TestString("absent") {
+		t.Error("cached and plain filters disagree on an absent key")
+	}
+	if n := len(f.cache.entries); n != 8 || f.cache.lru.Len() != 8 {
+		t.Errorf("cache holds %d entries, want 8", n)
+	}
+	if f.TotalAdds() != 1000 {
+		t.Errorf("TotalAdds = %d, want 1000", f.TotalAdds())
+	}
+	if NewWithHashCache(100, 3, 0).cache != nil {
+		t.Error("a cacheSize of zero should not create a cache")
+	}
+}
+
+func TestHashCacheConcurrent(t *testing.T) {
+	f := NewWithHashCache(10000, 4, 16)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprint((i * (w + 1)) % 40)
+				f.AddString(key)
+				if !f.TestString(key) {
+					t.Errorf("%q should be in", key)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// zipfKeys returns n keys drawn from a Zipfian distribution with exponent
+// s over 100000 distinct 256-byte keys. Repeated keys share their bytes, as
+// interned strings do.
+func zipfKeys(n int, s float64) []string {
+	distinct := make([]string, 100000)
+	for i := range distinct {
+		distinct[i] = fmt.Sprintf("%0256d", i)
+	}
+	z := rand.NewZipf(rand.New(rand.NewSource(1)), s, 1, uint64(len(distinct)-1))
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = distinct[z.Uint64()]
+	}
+	return keys
+}
+
+func benchmarkAddStringZipf(b *testing.B, s float64, cacheSize int) {
+	f := NewWithHashCache(1<<20, 4, cacheSize)
+	keys := zipfKeys(1<<16, s)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.AddString(keys[i%len(keys)])
+	}
+}
+
+// With an exponent of 1.2, about 80% of the keys hit a cache of 1024.
+func BenchmarkAddStringZipf(b *testing.B)       { benchmarkAddStringZipf(b, 1.2, 0) }
+func BenchmarkAddStringZipfCached(b *testing.B) { benchmarkAddStringZipf(b, 1.2, 1024) }
+
+// With an exponent of 2, nearly all of them do.
+func BenchmarkAddStringZipf2(b *testing.B)       { benchmarkAddStringZipf(b, 2, 0) }
+func BenchmarkAddStringZipf2Cached(b *testing.B) { benchmarkAddStringZipf(b, 2, 1024) }
@@ -40,6 +40,7 @@ package bloom
 
 import (
 	"encoding/binary"
+	"io"
 	"math/bits"
 	"unsafe"
 )
@@ -287,3 +288,80 @@ func (d *Digest128) Sum256(data []byte) (hash1, hash2, hash3, hash4 uint64) {
 
 	return hash1, hash2, hash3, hash4
 }
+
+// sumFirst128 computes the first two of the four Sum256 hash values,
+// v1 and v2 above. It leaves the digest ready for sumSecond128. Together
+// they are Sum256 split in two for IsLikelyNew, which often needs only the
+// first half; Sum256 keeps its single pass since every Add and Test goes
+// through it.
+func (d *Digest128) sumFirst128(data []byte) (hash1, hash2 uint64) {
+	// We always start from zero.
+	d.h1, d.h2 = 0, 0
+	// Process as many bytes as possible.
+	d.bmix(data)
+	// We have enough to compute the first two 64-bit numbers
+	length := uint(len(data))
+	tail_length := length % block_size
+	tail := data[length-tail_length:]
+	return d.Sum128(false, length, tail)
+}
+
+// sumSecond128 computes the last two of the four Sum256 hash values,
+// v3 and v4 above. It must follow sumFirst128 on the same data.
+func (d *Digest128) sumSecond128(data []byte) (hash3, hash4 uint64) {
+	length := uint(len(data))
+	tail_length := length % block_size
+	return d.sumSecondTail(length, data[length-tail_length:])
+}
+
+// sumSecondTail is sumSecond128 given only the length of the data and its
+// tail, the bytes after the last complete block.
+func (d *Digest128) sumSecondTail(length uint, tail []byte) (hash3, hash4 uint64) {
+	tail_length := uint(len(tail))
+	// Next we want to 'virtually' append 1 to the input, but,
+	// we do not want to append to an actual array!!!
+	if tail_length+1 == block_size {
+		// We are left with no tail!!!
+		word1 := binary.LittleEndian.Uint64(tail[:8])
+		word2 := uint64(binary.LittleEndian.Uint32(tail[8 : 8+4]))
+		word2 = word2 | (uint64(tail[12]) << 32) | (uint64(tail[13]) << 40) | (uint64(tail[14]) << 48)
+		// We append 1.
+		word2 = word2 | (uint64(1) << 56)
+		// We process the resulting 2 words.
+		d.bmix_words(word1, word2)
+		tail := tail[tail_length:] // empty slice, deliberate.
+		return d.Sum128(false, length+1, tail)
+	}
+	// We still have a tail (fewer than 15 bytes) but we
+	// need to append '1' to it.
+	return d.Sum128(true, length+1, tail)
+}
+
+// sum256Reader is Sum256 over the bytes read from r up to io.EOF. The
+// bytes are hashed as they are read, through a buffer of a few blocks, so
+// the data never needs to fit in memory. Returns the first error other
+// than io.EOF, in which case the hash values are meaningless.
+func (d *Digest128) sum256Reader(r io.Reader) (h [4]uint64, err error) {
+	d.h1, d.h2 = 0, 0
+	var buf [32 * block_size]byte
+	var length uint
+	buffered := 0 // Bytes at the start of buf not hashed yet, fewer than a block
+	for {
+		n, err := r.Read(buf[buffered:])
+		buffered += n
+		length += uint(n)
+		full := buffered - buffered%block_size
+		d.bmix(buf[:full])
+		buffered = copy(buf[:], buf[full:buffered])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return h, err
+		}
+	}
+	tail := buf[:buffered]
+	h[0], h[1] = d.Sum128(false, length, tail)
+	h[2], h[3] = d.sumSecondTail(length, tail)
+	return h, nil
+}
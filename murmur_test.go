@@ -1,8 +1,12 @@
 package bloom
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"math/rand"
 	"testing"
+	"testing/iotest"
 
 	"github.com/twmb/murmur3"
 )
@@ -62,3 +66,32 @@ func TestHashRandom(t *testing.T) {
 		}
 	}
 }
+
+func TestSum256Reader(t *testing.T) {
+	data := make([]byte, 1100)
+	rand.New(rand.NewSource(1)).Read(data)
+	readers := map[string]func([]byte) io.Reader{
+		"whole":    func(b []byte) io.Reader { return bytes.NewReader(b) },
+		"one byte": func(b []byte) io.Reader { return iotest.OneByteReader(bytes.NewReader(b)) },
+		"half":     func(b []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(b)) },
+		"data EOF": func(b []byte) io.Reader { return iotest.DataErrReader(bytes.NewReader(b)) },
+	}
+	for name, reader := range readers {
+		for length := 0; length <= len(data); length++ {
+			var d Digest128
+			got, err := d.sum256Reader(reader(data[:length]))
+			if err != nil {
+				t.Fatalf("%s, length %d: %v", name, length, err)
+			}
+			if want := baseHashes(data[:length]); got != want {
+				t.Fatalf("%s, length %d: streamed hashes differ from Sum256", name, length)
+			}
+		}
+	}
+
+	errRead := errors.New("read failed")
+	var d Digest128
+	if _, err := d.sum256Reader(io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errRead))); err != errRead {
+		t.Errorf("sum256Reader error = %v, want %v", err, errRead)
+	}
+}
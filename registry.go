@@ -0,0 +1,162 @@
+package bloom
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// registryExt is the file extension used by Registry.SaveAll and LoadAll.
+const registryExt = ".bloom"
+
+// A Registry holds Bloom filters by name, so that a set of filters can be
+// saved and reloaded together. It is safe for concurrent use.
+type Registry struct {
+	mu      sync.RWMutex
+	filters map[string]*BloomFilter
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{filters: make(map[string]*BloomFilter)}
+}
+
+// Get returns the filter registered under name, if any.
+func (r *Registry) Get(name string) (*BloomFilter, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.filters[name]
+	return f, ok
+}
+
+// Put registers f under name, replacing any filter previously registered
+// under that name.
+func (r *Registry) Put(name string, f *BloomFilter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.filters[name] = f
+}
+
+// Names returns the names of all registered filters, in no particular order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.filters))
+	for name := range r.filters {
+		names = append(names, name)
+	}
+	return names
+}
+
+// SaveAll writes every registered filter to dir, one file per filter, using
+// WriteToAtomic, so that a failed or interrupted save never leaves a
+// truncated file behind. The file name is the path-escaped filter name
+// followed by ".bloom". Filters may keep being used while they are saved;
+// see Merge for what a concurrently modified filter looks like.
+func (r *Registry) SaveAll(dir string) error {
+	r.mu.RLock()
+	snapshot := make(map[string]*BloomFilter, len(r.filters))
+	for name, f := range r.filters {
+		snapshot[name] = f
+	}
+	r.mu.RUnlock()
+
+	for name, f := range snapshot {
+		if err := f.WriteToAtomic(filepath.Join(dir, url.PathEscape(name)+registryExt)); err != nil {
+			return fmt.Errorf("saving filter %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// WriteToAtomic writes f, as WriteTo, to the file at path without ever
+// leaving a partially written file there: the filter goes to a temporary
+// file in the same directory, which is synced to disk and then renamed over
+// path. If the process crashes before the rename, path still holds its
+// previous contents; a leftover temporary file, named after path with a
+// ".tmp" suffix and a random part, can be removed. The directory itself is
+// not synced, so after a power loss the rename may not have happened yet.
+func (f *BloomFilter) WriteToAtomic(path string) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	fail := func(err error) error {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if _, err := f.WriteTo(w); err != nil {
+		return fail(err)
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := file.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// LoadAll reads every ".bloom" file in dir, as written by SaveAll, and
+// registers the filters under their names. Filters already registered under
+// other names are kept. Nothing is registered unless every file loads.
+func (r *Registry) LoadAll(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]*BloomFilter)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), registryExt) {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(entry.Name(), registryExt))
+		if err != nil {
+			return fmt.Errorf("invalid filter file name %q: %w", entry.Name(), err)
+		}
+		f, err := loadFilter(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("loading filter %q: %w", name, err)
+		}
+		loaded[name] = f
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, f := range loaded {
+		r.filters[name] = f
+	}
+	return nil
+}
+
+func loadFilter(path string) (*BloomFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var f BloomFilter
+	if _, err := f.ReadFrom(bufio.NewReader(file)); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
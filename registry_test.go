@@ -0,0 +1,186 @@
+package bloom
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestRegistrySaveLoadAll(t *testing.T) {
+	names := []string{"users", "sessions/active", "100% done", ""}
+	r := NewRegistry()
+	for i, name := range names {
+		f := New(uint(500+i*100), uint(3+i))
+		for j := 0; j < 20; j++ {
+			f.AddString(fmt.Sprintf("%s-%d", name, j))
+		}
+		r.Put(name, f)
+	}
+
+	dir := t.TempDir()
+	if err := r.SaveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	// Unrelated files are ignored when loading.
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewRegistry()
+	if err := loaded.LoadAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	got := loaded.Names()
+	sort.Strings(got)
+	want := append([]string(nil), names...)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("loaded names %q, want %q", got, want)
+	}
+	for _, name := range names {
+		f, _ := r.Get(name)
+		g, ok := loaded.Get(name)
+		if !ok {
+			t.Fatalf("filter %q missing after LoadAll", name)
+		}
+		if !f.Equal(g) {
+			t.Errorf("filter %q differs after LoadAll", name)
+		}
+		if !g.TestString(name + "-0") {
+			t.Errorf("filter %q lost its content", name)
+		}
+	}
+}
+
+func TestRegistryLoadAllCorrupt(t *testing.T) {
+	r := NewRegistry()
+	r.Put("a", New(100, 3))
+	dir := t.TempDir()
+	if err := r.SaveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.bloom"), []byte{1, 2, 3}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewRegistry()
+	if err := loaded.LoadAll(dir); err == nil {
+		t.Error("expected an error loading a truncated file")
+	}
+	if _, ok := loaded.Get("a"); ok {
+		t.Error("nothing should be registered when a file fails to load")
+	}
+}
+
+func TestRegistrySaveAllAtomic(t *testing.T) {
+	r := NewRegistry()
+	r.Put("a", New(100, 3).AddString("old"))
+	dir := t.TempDir()
+	if err := r.SaveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	// "b" cannot be saved over a directory; "a" must stay a complete
+	// filter whichever of the two is saved first.
+	if err := os.Mkdir(filepath.Join(dir, "b.bloom"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	r.Put("a", New(100, 3).AddString("new"))
+	r.Put("b", New(100, 3))
+	if err := r.SaveAll(dir); err == nil {
+		t.Fatal("expected an error saving over a directory")
+	}
+	g, err := loadFilter(filepath.Join(dir, "a.bloom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.TestString("old") && !g.TestString("new") {
+		t.Error("a.bloom holds neither the old nor the new filter")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("dir holds %q, want only a.bloom and b.bloom", names)
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	r := NewRegistry()
+	done := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		go func(w int) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 100; i++ {
+				name := fmt.Sprintf("f%d", i%10)
+				r.Put(name, New(64, 2))
+				if f, ok := r.Get(name); ok {
+					f.AddString(fmt.Sprint(w))
+				}
+			}
+		}(w)
+	}
+	for w := 0; w < 4; w++ {
+		<-done
+	}
+	if n := len(r.Names()); n != 10 {
+		t.Errorf("got %d names, want 10", n)
+	}
+}
+
+func TestWriteToAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "filter.bloom")
+	f := New(1000, 4).AddString("first")
+	if err := f.WriteToAtomic(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a checkpoint interrupted before the rename: a partially
+	// written temporary file next to the original.
+	g := f.Copy().AddString("second")
+	data, err := g.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, ".filter.bloom.tmp123")
+	if err := os.WriteFile(tmp, data[:len(data)/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadFilter(path)
+	if err != nil {
+		t.Fatalf("original file is damaged: %v", err)
+	}
+	if !loaded.Equal(f) || loaded.TestString("second") {
+		t.Error("original file should be intact after an interrupted checkpoint")
+	}
+	os.Remove(tmp)
+
+	if err := g.WriteToAtomic(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = loadFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(g) {
+		t.Error("file should hold the new checkpoint")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the filter", len(entries))
+	}
+
+	// A failed write leaves nothing behind.
+	if err := f.WriteToAtomic(filepath.Join(dir, "missing", "filter.bloom")); err == nil {
+		t.Error("writing into a missing directory should fail")
+	}
+}
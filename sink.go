@@ -0,0 +1,48 @@
+package bloom
+
+import "errors"
+
+// A MergeSink unions many Bloom filters of the same shape into a single
+// result, for instance the per-shard filters of a map-reduce job. Add and
+// Drain may be called from any number of goroutines, and they merge
+// concurrently: unlike Merge, they don't take the result's mutation lock,
+// so a ClearAllSync of the result is not ordered against them.
+type MergeSink struct {
+	result *BloomFilter
+}
+
+// NewMergeSink creates a MergeSink accepting filters with _m_ bits and _k_
+// hashing functions.
+func NewMergeSink(m, k uint) *MergeSink {
+	return &MergeSink{result: New(m, k)}
+}
+
+// Add merges g into the result. Returns an error if g's parameters don't
+// match the sink's.
+func (s *MergeSink) Add(g *BloomFilter) error {
+	if err := s.result.compatible(g); err != nil {
+		return err
+	}
+	s.result.bitset().orWords(g.bitset())
+	return nil
+}
+
+// Drain merges every filter received from ch into the result until ch is
+// closed. Filters whose parameters don't match are skipped; the returned
+// error joins the errors for all of them.
+func (s *MergeSink) Drain(ch <-chan *BloomFilter) error {
+	var errs []error
+	for g := range ch {
+		if err := s.Add(g); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Result returns the union of the filters merged so far. The filter is
+// shared with the sink, so it keeps changing while filters are still being
+// added; take a Copy to keep a snapshot.
+func (s *MergeSink) Result() *BloomFilter {
+	return s.result
+}
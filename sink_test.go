@@ -0,0 +1,93 @@
+package bloom
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMergeSinkConcurrent(t *testing.T) {
+	const m, k, shards = 10000, 4, 64
+	filters := make([]*BloomFilter, shards)
+	serial := New(m, k)
+	for i := range filters {
+		filters[i] = New(m, k)
+		for j := 0; j < 50; j++ {
+			filters[i].AddString(fmt.Sprintf("%d-%d", i, j))
+		}
+		if err := serial.Merge(filters[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sink := NewMergeSink(m, k)
+	ch := make(chan *BloomFilter)
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- sink.Drain(ch)
+		}()
+	}
+	for _, f := range filters[:shards/2] {
+		ch <- f
+	}
+	ch <- New(m+1, k)
+	close(ch)
+	// The rest go through Add directly, concurrently with Drain.
+	for _, f := range filters[shards/2:] {
+		wg.Add(1)
+		go func(f *BloomFilter) {
+			defer wg.Done()
+			if err := sink.Add(f); err != nil {
+				t.Error(err)
+			}
+		}(f)
+	}
+	wg.Wait()
+	close(errs)
+
+	mismatched := 0
+	for err := range errs {
+		if err != nil {
+			mismatched++
+		}
+	}
+	if mismatched != 1 {
+		t.Errorf("got %d Drain errors, want 1 for the mismatched filter", mismatched)
+	}
+	if !sink.Result().Equal(serial) {
+		t.Error("concurrent merge differs from serial merge")
+	}
+}
+
+func BenchmarkMergeSinkConcurrent(b *testing.B) {
+	benchmarkMergeConcurrent(b, func(s *MergeSink, g *BloomFilter) error { return s.Add(g) })
+}
+
+// BenchmarkMergeConcurrent is the same workload through Merge, which
+// serializes the merges on the result's mutation lock.
+func BenchmarkMergeConcurrent(b *testing.B) {
+	benchmarkMergeConcurrent(b, func(s *MergeSink, g *BloomFilter) error { return s.Result().Merge(g) })
+}
+
+func benchmarkMergeConcurrent(b *testing.B, merge func(*MergeSink, *BloomFilter) error) {
+	const m, k = 1 << 20, 4
+	sink := NewMergeSink(m, k)
+	g := New(m, k)
+	for i := 0; i < 10000; i++ {
+		g.AddString(fmt.Sprint(i))
+	}
+	b.SetBytes(m / 8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := merge(sink, g); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
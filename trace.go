@@ -0,0 +1,40 @@
+package bloom
+
+import "time"
+
+// A TraceEvent describes an expensive operation on a BloomFilter, reported
+// to the tracer set with SetTracer once the operation returns.
+type TraceEvent struct {
+	Op       string        // "AddBatch", "Merge", "WriteTo" or "ReadFrom"
+	Start    time.Time     // When the operation started
+	Duration time.Duration // How long it took
+	Items    int           // Number of items added, for AddBatch
+	Bytes    int64         // Number of bytes written or read, for WriteTo and ReadFrom
+	Err      error         // The error returned, if any
+}
+
+// SetTracer sets a function called with a TraceEvent after every AddBatch,
+// Merge, WriteTo and ReadFrom on f, including those made by other methods
+// such as MarshalBinary. A nil tracer, the default, disables tracing at the
+// cost of a nil check per operation. The tracer is called synchronously on
+// the goroutine that ran the operation, so it must be quick and safe for
+// concurrent use. SetTracer is not synchronized with the traced
+// operations: call it before the filter is shared. Copies and decoded
+// filters have no tracer.
+func (f *BloomFilter) SetTracer(tracer func(TraceEvent)) {
+	f.tracer = tracer
+}
+
+// traceSpan reports an operation of f that started at start to its tracer.
+// It is deferred with pointers to the operation's results, either of which
+// may be nil, so that it reports their final values.
+func (f *BloomFilter) traceSpan(op string, start time.Time, items int, n *int64, err *error) {
+	e := TraceEvent{Op: op, Start: start, Duration: time.Since(start), Items: items}
+	if n != nil {
+		e.Bytes = *n
+	}
+	if err != nil {
+		e.Err = *err
+	}
+	f.tracer(e)
+}
@@ -0,0 +1,71 @@
+package bloom
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	var mu sync.Mutex
+	var events []TraceEvent
+	f := New(1000, 4)
+	f.SetTracer(func(e TraceEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+
+	f.AddBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	if err := f.Merge(New(1000, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Merge(New(999, 4)); err == nil {
+		t.Fatal("expected an m mismatch")
+	}
+	var buf bytes.Buffer
+	written, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := f.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadFrom(&buf); err == nil {
+		t.Fatal("expected an error reading an exhausted stream")
+	}
+
+	want := []struct {
+		op     string
+		items  int
+		bytes  int64
+		failed bool
+	}{
+		{op: "AddBatch", items: 3},
+		{op: "Merge"},
+		{op: "Merge", failed: true},
+		{op: "WriteTo", bytes: written},
+		{op: "ReadFrom", bytes: read},
+		{op: "ReadFrom", failed: true},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, e := range events {
+		w := want[i]
+		if e.Op != w.op || e.Items != w.items || e.Bytes != w.bytes || (e.Err != nil) != w.failed {
+			t.Errorf("event %d = %+v, want %+v", i, e, w)
+		}
+		if e.Start.IsZero() || e.Duration < 0 {
+			t.Errorf("event %d has no timing: %+v", i, e)
+		}
+	}
+
+	// Without a tracer nothing is reported.
+	f.SetTracer(nil)
+	f.AddBatch([][]byte{[]byte("d")})
+	if len(events) != len(want) {
+		t.Error("events reported after the tracer was removed")
+	}
+}
@@ -0,0 +1,41 @@
+package bloom
+
+// Vector is a test vector pinning the hashing of one key: the four base
+// hashes computed with murmur3 (see Digest128.Sum256) and the bit positions
+// they select in a filter with M bits and K hashing functions.
+type Vector struct {
+	Key        []byte
+	M, K       uint
+	BaseHashes [4]uint64
+	Locations  []uint // Bit positions, in probe order
+}
+
+// TestVectors returns a fixed set of vectors that any implementation of
+// this filter's hashing must reproduce, so that filters built elsewhere can
+// be read here and vice versa. They cover empty and short keys, keys around
+// the 16-byte murmur3 block size, and both a modulo (m = 1000) and a
+// power-of-two (m = 1024) filter.
+func TestVectors() []Vector {
+	return []Vector{
+		{Key: []byte(""), M: 1000, K: 7, BaseHashes: [4]uint64{0x0, 0x0, 0x7ace5c908374fe16, 0x778867e4430e6785}, Locations: []uint{0, 493, 986, 970, 832, 233, 726}},
+		{Key: []byte("a"), M: 1000, K: 7, BaseHashes: [4]uint64{0x85555565f6597889, 0xe6b53a48510e895a, 0x97681c547e0fe98f, 0x7c180e2fc253d2e0}, Locations: []uint{801, 842, 105, 863, 365, 450, 713}},
+		{Key: []byte("abc"), M: 1000, K: 7, BaseHashes: [4]uint64{0xb4963f3f3fad7867, 0x3ba2744126ca2d52, 0x7d35b1b42c0b2132, 0x4b26cbf47f02216c}, Locations: []uint{575, 774, 839, 112, 535, 918, 983}},
+		{Key: []byte("hello world"), M: 1000, K: 7, BaseHashes: [4]uint64{0x533f6046eb7f610e, 0xab97467d60eb63b1, 0x75354881f751995, 0x154d712fb18b36a3}, Locations: []uint{910, 140, 892, 840, 498, 488, 856}},
+		{Key: []byte("0123456789abcd"), M: 1000, K: 7, BaseHashes: [4]uint64{0x7a4a014dd59f71a, 0xaaf437854cd22231, 0xa942b3089039da86, 0xd66a453dfb7e51f7}, Locations: []uint{914, 520, 648, 779, 82, 372, 884}},
+		{Key: []byte("0123456789abcde"), M: 1000, K: 7, BaseHashes: [4]uint64{0xa62dd5f6c0bf2351, 0x4fccf50c7c544cf0, 0x97287844a8f9327b, 0x68188b127b1950cd}, Locations: []uint{889, 877, 139, 209, 37, 377, 639}},
+		{Key: []byte("0123456789abcdef"), M: 1000, K: 7, BaseHashes: [4]uint64{0x4be06d94cf4ad1a7, 0x87c35b5c63a708da, 0x2442333c5ce05bc6, 0xeb64b8f4262afd6a}, Locations: []uint{583, 836, 675, 564, 615, 20, 475}},
+		{Key: []byte("0123456789abcdef0"), M: 1000, K: 7, BaseHashes: [4]uint64{0xeb24ae8785a5c075, 0x73fb68b3313128ca, 0xf5a70bfdd17df81f, 0x91584d3d7e24c90c}, Locations: []uint{997, 894, 237, 303, 369, 606, 949}},
+		{Key: []byte("The quick brown fox jumps over the lazy dog"), M: 1000, K: 7, BaseHashes: [4]uint64{0xe34bbc7bbc071b6c, 0x7a433ca9c49a9347, 0xe7e132e9739c2bd8, 0xd37e4639b7e6ba2c}, Locations: []uint{348, 507, 740, 255, 940, 907, 140}},
+		{Key: []byte("\x00\x01\x02\x03\xff"), M: 1000, K: 7, BaseHashes: [4]uint64{0xe8a55b8749fa5505, 0xc675788020e1c9cf, 0x6651c5854d5d02b7, 0x727543459dc429b9}, Locations: []uint{501, 168, 927, 716, 361, 20, 779}},
+		{Key: []byte(""), M: 1024, K: 4, BaseHashes: [4]uint64{0x0, 0x0, 0x7ace5c908374fe16, 0x778867e4430e6785}, Locations: []uint{0, 901, 778, 578}},
+		{Key: []byte("a"), M: 1024, K: 4, BaseHashes: [4]uint64{0x85555565f6597889, 0xe6b53a48510e895a, 0x97681c547e0fe98f, 0x7c180e2fc253d2e0}, Locations: []uint{137, 58, 585, 519}},
+		{Key: []byte("abc"), M: 1024, K: 4, BaseHashes: [4]uint64{0xb4963f3f3fad7867, 0x3ba2744126ca2d52, 0x7d35b1b42c0b2132, 0x4b26cbf47f02216c}, Locations: []uint{103, 702, 831, 232}},
+		{Key: []byte("hello world"), M: 1024, K: 4, BaseHashes: [4]uint64{0x533f6046eb7f610e, 0xab97467d60eb63b1, 0x75354881f751995, 0x154d712fb18b36a3}, Locations: []uint{270, 596, 596, 112}},
+		{Key: []byte("0123456789abcd"), M: 1024, K: 4, BaseHashes: [4]uint64{0x7a4a014dd59f71a, 0xaaf437854cd22231, 0xa942b3089039da86, 0xd66a453dfb7e51f7}, Locations: []uint{794, 40, 776, 451}},
+		{Key: []byte("0123456789abcde"), M: 1024, K: 4, BaseHashes: [4]uint64{0xa62dd5f6c0bf2351, 0x4fccf50c7c544cf0, 0x97287844a8f9327b, 0x68188b127b1950cd}, Locations: []uint{849, 445, 235, 97}},
+		{Key: []byte("0123456789abcdef"), M: 1024, K: 4, BaseHashes: [4]uint64{0x4be06d94cf4ad1a7, 0x87c35b5c63a708da, 0x2442333c5ce05bc6, 0xeb64b8f4262afd6a}, Locations: []uint{423, 580, 123, 44}},
+		{Key: []byte("0123456789abcdef0"), M: 1024, K: 4, BaseHashes: [4]uint64{0xeb24ae8785a5c075, 0x73fb68b3313128ca, 0xf5a70bfdd17df81f, 0x91584d3d7e24c90c}, Locations: []uint{117, 470, 653, 295}},
+		{Key: []byte("The quick brown fox jumps over the lazy dog"), M: 1024, K: 4, BaseHashes: [4]uint64{0xe34bbc7bbc071b6c, 0x7a433ca9c49a9347, 0xe7e132e9739c2bd8, 0xd37e4639b7e6ba2c}, Locations: []uint{876, 371, 964, 719}},
+		{Key: []byte("\x00\x01\x02\x03\xff"), M: 1024, K: 4, BaseHashes: [4]uint64{0xe8a55b8749fa5505, 0xc675788020e1c9cf, 0x6651c5854d5d02b7, 0x727543459dc429b9}, Locations: []uint{261, 904, 119, 500}},
+	}
+}
@@ -0,0 +1,36 @@
+package bloom
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTestVectors(t *testing.T) {
+	vectors := TestVectors()
+	if len(vectors) == 0 {
+		t.Fatal("no test vectors")
+	}
+	for _, v := range vectors {
+		if h := baseHashes(v.Key); h != v.BaseHashes {
+			t.Errorf("%q: base hashes %#x, want %#x", v.Key, h, v.BaseHashes)
+		}
+		f := New(v.M, v.K)
+		locs := make([]uint, v.K)
+		for i := range locs {
+			locs[i] = f.location(v.BaseHashes, uint(i))
+		}
+		if !slices.Equal(locs, v.Locations) {
+			t.Errorf("%q, m=%d, k=%d: locations %v, want %v", v.Key, v.M, v.K, locs, v.Locations)
+		}
+
+		// Adding the key sets exactly the listed bits.
+		f.Add(v.Key)
+		want := New(v.M, v.K)
+		for _, l := range v.Locations {
+			want.bitset().Set(l)
+		}
+		if !f.Equal(want) {
+			t.Errorf("%q, m=%d, k=%d: Add does not set exactly the vector's bits", v.Key, v.M, v.K)
+		}
+	}
+}